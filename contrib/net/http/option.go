@@ -129,6 +129,7 @@ type roundTripperConfig struct {
 	resourceNamer func(req *http.Request) string
 	ignoreRequest func(*http.Request) bool
 	spanOpts      []ddtrace.StartSpanOption
+	finishOnClose bool
 }
 
 func newRoundTripperConfig() *roundTripperConfig {
@@ -216,3 +217,16 @@ func RTWithIgnoreRequest(f func(*http.Request) bool) RoundTripperOption {
 		cfg.ignoreRequest = f
 	}
 }
+
+// RTWithFinishOnBodyClose specifies whether spans should be finished when the body
+// of the response is closed, or fully read, rather than when RoundTrip returns. This
+// makes the duration of the span cover streamed responses, which complete after
+// RoundTrip returns, and records errors occurring while reading them. Callers must
+// then always close response bodies, as they should; otherwise spans are never
+// finished. Spans of upgraded connections (101 Switching Protocols) are still
+// finished when RoundTrip returns, leaving their bodies untouched.
+func RTWithFinishOnBodyClose(on bool) RoundTripperOption {
+	return func(cfg *roundTripperConfig) {
+		cfg.finishOnClose = on
+	}
+}
@@ -7,10 +7,12 @@ package http
 
 import (
 	"fmt"
+	"io"
 	"math"
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
@@ -47,6 +49,13 @@ func (rt *roundTripper) RoundTrip(req *http.Request) (res *http.Response, err er
 		if rt.cfg.after != nil {
 			rt.cfg.after(res, span)
 		}
+		// the body of a 101 response is the upgraded connection, an io.ReadWriteCloser
+		// which must not be hidden by the wrapper
+		if err == nil && rt.cfg.finishOnClose && res.Body != nil && res.Body != http.NoBody &&
+			res.StatusCode != http.StatusSwitchingProtocols {
+			res.Body = &tracedBody{ReadCloser: res.Body, span: span}
+			return
+		}
 		span.Finish(tracer.WithError(err))
 	}()
 	if rt.cfg.before != nil {
@@ -74,6 +83,39 @@ func (rt *roundTripper) RoundTrip(req *http.Request) (res *http.Response, err er
 	return res, err
 }
 
+// tracedBody finishes the span of a request once its response body is closed or
+// fully read, recording any error occurring while reading it.
+type tracedBody struct {
+	io.ReadCloser
+	span ddtrace.Span
+	once sync.Once
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.finish(nil)
+	} else if err != nil {
+		b.finish(err)
+	}
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish(nil)
+	return err
+}
+
+func (b *tracedBody) finish(err error) {
+	b.once.Do(func() {
+		if err != nil {
+			b.span.SetTag("http.errors", err.Error())
+		}
+		b.span.Finish(tracer.WithError(err))
+	})
+}
+
 // Unwrap returns the original http.RoundTripper.
 func (rt *roundTripper) Unwrap() http.RoundTripper {
 	return rt.base
@@ -81,6 +123,11 @@ func (rt *roundTripper) Unwrap() http.RoundTripper {
 
 // WrapRoundTripper returns a new RoundTripper which traces all requests sent
 // over the transport.
+// A span is started for each request, as a child of the span found in the
+// request's context, and the trace is propagated by injecting its headers into
+// the request. As http.Client sends the request of each redirect using the
+// transport, every hop of a redirected request gets a span of its own. Spans are
+// finished when RoundTrip returns, unless RTWithFinishOnBodyClose is used.
 func WrapRoundTripper(rt http.RoundTripper, opts ...RoundTripperOption) http.RoundTripper {
 	cfg := newRoundTripperConfig()
 	for _, opt := range opts {
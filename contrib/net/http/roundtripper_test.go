@@ -6,10 +6,14 @@
 package http
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/stretchr/testify/assert"
@@ -377,3 +381,118 @@ func TestSpanOptions(t *testing.T) {
 	assert.Len(t, spans, 1)
 	assert.Equal(t, tagValue, spans[0].Tag(tagKey))
 }
+
+func TestRoundTripperRedirect(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer s.Close()
+
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	client := &http.Client{Transport: WrapRoundTripper(http.DefaultTransport)}
+	parent, ctx := tracer.StartSpanFromContext(context.Background(), "parent")
+	req, _ := http.NewRequestWithContext(ctx, "GET", s.URL+"/old", nil)
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	parent.Finish()
+
+	spans := mt.FinishedSpans()
+	assert.Len(t, spans, 3)
+	assert.Equal(t, s.URL+"/old", spans[0].Tag(ext.HTTPURL))
+	assert.Equal(t, "302", spans[0].Tag(ext.HTTPCode))
+	assert.Equal(t, s.URL+"/new", spans[1].Tag(ext.HTTPURL))
+	assert.Equal(t, "200", spans[1].Tag(ext.HTTPCode))
+	for _, s := range spans[:2] {
+		assert.Equal(t, parent.Context().SpanID(), s.ParentID())
+	}
+}
+
+func TestRoundTripperFinishOnBodyClose(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("streamed"))
+	}))
+	defer s.Close()
+
+	t.Run("close", func(t *testing.T) {
+		mt := mocktracer.Start()
+		defer mt.Stop()
+		client := &http.Client{Transport: WrapRoundTripper(http.DefaultTransport, RTWithFinishOnBodyClose(true))}
+		res, err := client.Get(s.URL)
+		assert.NoError(t, err)
+		assert.Len(t, mt.FinishedSpans(), 0, "span must be finished once the body is closed")
+		res.Body.Close()
+		res.Body.Close()
+		spans := mt.FinishedSpans()
+		assert.Len(t, spans, 1)
+		assert.Equal(t, "200", spans[0].Tag(ext.HTTPCode))
+	})
+
+	t.Run("read", func(t *testing.T) {
+		mt := mocktracer.Start()
+		defer mt.Stop()
+		client := &http.Client{Transport: WrapRoundTripper(http.DefaultTransport, RTWithFinishOnBodyClose(true))}
+		res, err := client.Get(s.URL)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "streamed", string(body))
+		assert.Len(t, mt.FinishedSpans(), 1)
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			brw.Flush()
+			io.Copy(conn, brw)
+		}))
+		defer s.Close()
+		mt := mocktracer.Start()
+		defer mt.Stop()
+		client := &http.Client{Transport: WrapRoundTripper(http.DefaultTransport, RTWithFinishOnBodyClose(true))}
+		req, err := http.NewRequest("GET", s.URL, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "echo")
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+		defer res.Body.Close()
+		spans := mt.FinishedSpans()
+		assert.Len(t, spans, 1)
+		assert.Equal(t, "101", spans[0].Tag(ext.HTTPCode))
+		conn, ok := res.Body.(io.ReadWriteCloser)
+		assert.True(t, ok, "the upgraded connection must stay writable")
+		_, err = conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(buf))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		mt := mocktracer.Start()
+		defer mt.Stop()
+		sp := tracer.StartSpan("http.request")
+		body := &tracedBody{ReadCloser: io.NopCloser(iotest.ErrReader(errors.New("reset"))), span: sp}
+		_, err := body.Read(make([]byte, 1))
+		assert.Error(t, err)
+		body.Close()
+		spans := mt.FinishedSpans()
+		assert.Len(t, spans, 1)
+		assert.Equal(t, "reset", spans[0].Tag("http.errors"))
+		assert.NotNil(t, spans[0].Tag(ext.Error))
+	})
+}
@@ -18,4 +18,7 @@ const (
 	DBUser = "db.user"
 	// DBStatement records a database statement for the given database type.
 	DBStatement = "db.statement"
+	// DBRowCount indicates the number of rows returned or affected by a statement.
+	// It should be set as a number, so that it is recorded as a metric.
+	DBRowCount = "db.row_count"
 )
@@ -29,6 +29,9 @@ func TestSpec(t *testing.T) {
 		SQLQuery, "sql.query",
 		HTTPURL, "http.url",
 		Environment, "env",
+		DBRowCount, "db.row_count",
+		HTTPRequestContentLength, "http.request.content_length",
+		HTTPResponseContentLength, "http.response.content_length",
 	}
 	if len(tests)%2 != 0 {
 		t.Fatal("uneven test count")
@@ -47,6 +47,14 @@ const (
 	// See https://docs.datadoghq.com/tracing/trace_collection/tracing_naming_convention/#http-requests
 	HTTPRequestHeaders = "http.request.headers"
 
+	// HTTPRequestContentLength is the size in bytes of the HTTP request body.
+	// It should be set as a number, so that it is recorded as a metric.
+	HTTPRequestContentLength = "http.request.content_length"
+
+	// HTTPResponseContentLength is the size in bytes of the HTTP response body.
+	// It should be set as a number, so that it is recorded as a metric.
+	HTTPResponseContentLength = "http.response.content_length"
+
 	// SpanName is a pseudo-key for setting a span's operation name by means of
 	// a tag. It is mostly here to facilitate vendor-agnostic frameworks like Opentracing
 	// and OpenCensus.
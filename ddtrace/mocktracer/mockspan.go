@@ -170,8 +170,10 @@ func (s *mockspan) OperationName() string {
 func (s *mockspan) SetOperationName(operationName string) {
 	s.Lock()
 	defer s.Unlock()
+	if s.finished {
+		return
+	}
 	s.name = operationName
-	return
 }
 
 // BaggageItem returns the baggage item with the given key.
@@ -13,11 +13,14 @@
 package mocktracer
 
 import (
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/internal"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
@@ -33,6 +36,24 @@ type Tracer interface {
 	// FinishedSpans returns the set of finished spans.
 	FinishedSpans() []Span
 
+	// WaitForFinishedSpans waits until at least n spans have finished, or until the
+	// timeout has passed, and returns the set of finished spans. It is useful when
+	// spans are finished in a different goroutine than the one running the test.
+	WaitForFinishedSpans(n int, timeout time.Duration) []Span
+
+	// FindSpan returns the first finished span for which match returns true, or
+	// nil if there is none.
+	FindSpan(match func(Span) bool) Span
+
+	// Traces returns the finished spans grouped by trace, in the order in which
+	// the first span of each trace finished. It is useful to check the number of
+	// spans of each trace.
+	Traces() [][]Span
+
+	// Services returns the sorted set of services of the finished spans, to check
+	// that no service is missing or unexpected.
+	Services() []string
+
 	// Reset resets the spans and services recorded in the tracer. This is
 	// especially useful when running tests in a loop, where a clean start
 	// is desired for FinishedSpans calls.
@@ -58,6 +79,7 @@ type mocktracer struct {
 	sync.RWMutex  // guards below spans
 	finishedSpans []Span
 	openSpans     map[uint64]Span
+	finished      chan struct{} // closed when a span finishes, if anyone is waiting
 }
 
 func newMockTracer() *mocktracer {
@@ -96,10 +118,81 @@ func (t *mocktracer) OpenSpans() []Span {
 	return spans
 }
 
+// FinishedSpans returns a copy of the set of finished spans. Finished spans can
+// not be modified, so the test code can not alter them.
 func (t *mocktracer) FinishedSpans() []Span {
 	t.RLock()
 	defer t.RUnlock()
-	return t.finishedSpans
+	return t.finishedSpansLocked()
+}
+
+// finishedSpansLocked returns a copy of the finished spans. The tracer must be
+// locked by the caller.
+func (t *mocktracer) finishedSpansLocked() []Span {
+	if t.finishedSpans == nil {
+		return nil
+	}
+	return append([]Span(nil), t.finishedSpans...)
+}
+
+func (t *mocktracer) FindSpan(match func(Span) bool) Span {
+	for _, s := range t.FinishedSpans() {
+		if match(s) {
+			return s
+		}
+	}
+	return nil
+}
+
+func (t *mocktracer) Traces() [][]Span {
+	var traces [][]Span
+	index := make(map[uint64]int)
+	for _, s := range t.FinishedSpans() {
+		i, ok := index[s.TraceID()]
+		if !ok {
+			i = len(traces)
+			index[s.TraceID()] = i
+			traces = append(traces, nil)
+		}
+		traces[i] = append(traces[i], s)
+	}
+	return traces
+}
+
+func (t *mocktracer) Services() []string {
+	seen := make(map[string]bool)
+	var services []string
+	for _, s := range t.FinishedSpans() {
+		svc, _ := s.Tag(ext.ServiceName).(string)
+		if svc == "" || seen[svc] {
+			continue
+		}
+		seen[svc] = true
+		services = append(services, svc)
+	}
+	sort.Strings(services)
+	return services
+}
+
+func (t *mocktracer) WaitForFinishedSpans(n int, timeout time.Duration) []Span {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		t.Lock()
+		if t.finished == nil {
+			t.finished = make(chan struct{})
+		}
+		spans, finished := t.finishedSpansLocked(), t.finished
+		t.Unlock()
+		if len(spans) >= n {
+			return spans
+		}
+		select {
+		case <-finished:
+		case <-timer.C:
+			return spans
+		}
+	}
 }
 
 func (t *mocktracer) Reset() {
@@ -119,6 +212,11 @@ func (t *mocktracer) addFinishedSpan(s Span) {
 		t.finishedSpans = make([]Span, 0, 1)
 	}
 	t.finishedSpans = append(t.finishedSpans, s)
+	if t.finished != nil {
+		// wake up any callers of WaitForFinishedSpans
+		close(t.finished)
+		t.finished = nil
+	}
 }
 
 const (
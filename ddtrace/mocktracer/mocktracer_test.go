@@ -94,6 +94,71 @@ func TestTracerFinishedSpans(t *testing.T) {
 	assert.Equal(t, 2, found)
 }
 
+func TestTracerWaitForFinishedSpans(t *testing.T) {
+	assert := assert.New(t)
+	mt := newMockTracer()
+	parent := mt.StartSpan("http.request")
+	child := mt.StartSpan("db.query", tracer.ChildOf(parent.Context()))
+	go func() {
+		child.Finish()
+		parent.Finish()
+	}()
+	assert.Len(mt.WaitForFinishedSpans(2, time.Minute), 2)
+
+	// times out
+	mt.StartSpan("http.request")
+	assert.Len(mt.WaitForFinishedSpans(3, 10*time.Millisecond), 2)
+}
+
+func TestTracerFindSpan(t *testing.T) {
+	assert := assert.New(t)
+	mt := newMockTracer()
+	parent := mt.StartSpan("http.request")
+	child := mt.StartSpan("db.query", tracer.ChildOf(parent.Context()))
+	child.Finish()
+	parent.Finish()
+
+	byName := func(name string) func(Span) bool {
+		return func(s Span) bool { return s.OperationName() == name }
+	}
+	assert.Equal(child, mt.FindSpan(byName("db.query")))
+	assert.Equal(parent, mt.FindSpan(byName("http.request")))
+	assert.Nil(mt.FindSpan(byName("cache.get")))
+
+	// captured spans can not be altered
+	found := mt.FindSpan(byName("db.query"))
+	found.(ddtrace.Span).SetTag("key", "value")
+	found.(ddtrace.Span).SetOperationName("other")
+	assert.Nil(child.(Span).Tag("key"))
+	assert.Equal("db.query", child.(Span).OperationName())
+	spans := mt.FinishedSpans()
+	spans[0] = nil
+	assert.NotNil(mt.FinishedSpans()[0])
+}
+
+func TestTracerTraces(t *testing.T) {
+	assert := assert.New(t)
+	mt := newMockTracer()
+	root1 := mt.StartSpan("http.request", tracer.ServiceName("web"))
+	root2 := mt.StartSpan("worker.job", tracer.ServiceName("worker"))
+	child := mt.StartSpan("db.query", tracer.ChildOf(root1.Context()), tracer.ServiceName("db"))
+	mt.StartSpan("open").Finish()
+	root2.Finish()
+	child.Finish()
+	root1.Finish()
+
+	traces := mt.Traces()
+	assert.Len(traces, 3)
+	assert.Len(traces[0], 1)
+	assert.Equal([]Span{root2.(Span)}, traces[1])
+	assert.Equal([]Span{child.(Span), root1.(Span)}, traces[2])
+	assert.Equal([]string{"db", "web", "worker"}, mt.Services())
+
+	mt.Reset()
+	assert.Empty(mt.Traces())
+	assert.Empty(mt.Services())
+}
+
 func TestTracerOpenSpans(t *testing.T) {
 	mt := newMockTracer()
 	assert.Empty(t, mt.OpenSpans())
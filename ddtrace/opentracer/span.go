@@ -53,6 +53,8 @@ func (s *span) LogFields(fields ...log.Field) {
 			if err, ok := f.Value().(error); ok {
 				s.SetTag("error", err)
 			}
+		case "error.kind":
+			s.SetTag(ext.ErrorType, fmt.Sprint(f.Value()))
 		case "message":
 			s.SetTag(ext.ErrorMsg, fmt.Sprint(f.Value()))
 		case "stack":
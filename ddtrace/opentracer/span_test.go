@@ -0,0 +1,42 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016 Datadog, Inc.
+
+package opentracer
+
+import (
+	"testing"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/internal"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpanLogFields(t *testing.T) {
+	assert := assert.New(t)
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	ot := &opentracer{internal.GetGlobalTracer()}
+
+	sp := ot.StartSpan("test.operation")
+	sp.LogFields(
+		log.String("event", "error"),
+		log.String("error.kind", "Timeout"),
+		log.String("message", "request timed out"),
+		log.String("stack", "main.go:12"),
+		log.String("unknown", "value"),
+	)
+	sp.Finish()
+
+	spans := mt.FinishedSpans()
+	assert.Len(spans, 1)
+	assert.Equal(true, spans[0].Tag(ext.Error))
+	assert.Equal("Timeout", spans[0].Tag(ext.ErrorType))
+	assert.Equal("request timed out", spans[0].Tag(ext.ErrorMsg))
+	assert.Equal("main.go:12", spans[0].Tag(ext.ErrorStack))
+	assert.Nil(spans[0].Tag("unknown"))
+}
@@ -0,0 +1,93 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016 Datadog, Inc.
+
+package tracer
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// breakerFailureThreshold specifies the number of consecutive failed sends
+	// after which the circuit breaker opens.
+	breakerFailureThreshold = 5
+
+	// breakerCooldown specifies how long the circuit breaker stays open before
+	// allowing a new attempt through.
+	breakerCooldown = 30 * time.Second
+)
+
+// circuitBreaker prevents the trace writer from repeatedly waiting on an agent
+// which can not be reached. After a number of consecutive failures the circuit
+// opens and all attempts fail fast until the cooldown period has passed. The
+// circuit is then half-open: a single attempt is let through to probe the agent,
+// closing the circuit when it succeeds or opening it again when it fails.
+//
+// circuitBreaker is safe for concurrent use.
+type circuitBreaker struct {
+	threshold int           // consecutive failures which open the circuit
+	cooldown  time.Duration // time spent open before probing the agent again
+	now       func() time.Time
+
+	mu        sync.Mutex // guards below fields
+	failures  int        // number of consecutive failures
+	openUntil time.Time  // time until which the circuit stays open; zero when closed
+	probing   bool       // reports whether a probe is in flight while half-open
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow reports whether an attempt may be made. When the circuit is half-open,
+// only the first caller is allowed through until it reports its outcome.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		// closed
+		return true
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// success records a successful attempt, closing the circuit.
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+}
+
+// failure records a failed attempt. It reports whether this failure caused the
+// circuit to open.
+func (b *circuitBreaker) failure() (opened bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.probing || (b.openUntil.IsZero() && b.failures >= b.threshold) {
+		b.probing = false
+		b.openUntil = b.now().Add(b.cooldown)
+		return true
+	}
+	return false
+}
+
+// isOpen reports whether the circuit is currently open or half-open.
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero()
+}
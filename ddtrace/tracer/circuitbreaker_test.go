@@ -0,0 +1,83 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016 Datadog, Inc.
+
+package tracer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	b := newCircuitBreaker(3, time.Minute)
+	b.now = func() time.Time { return now }
+
+	// closed
+	for i := 0; i < 2; i++ {
+		assert.True(b.allow())
+		assert.False(b.failure())
+	}
+	b.success()
+	for i := 0; i < 2; i++ {
+		assert.False(b.failure())
+	}
+	assert.True(b.allow())
+	assert.True(b.failure())
+	assert.True(b.isOpen())
+
+	// open
+	assert.False(b.allow())
+	now = now.Add(30 * time.Second)
+	assert.False(b.allow())
+
+	// half-open; a single probe is allowed through
+	now = now.Add(30 * time.Second)
+	assert.True(b.allow())
+	assert.False(b.allow())
+	assert.True(b.failure())
+	assert.False(b.allow())
+
+	now = now.Add(time.Minute)
+	assert.True(b.allow())
+	b.success()
+	assert.False(b.isOpen())
+	assert.True(b.allow())
+	assert.True(b.allow())
+}
+
+// failingTransport is a transport which fails every send.
+type failingTransport struct{ dummyTransport }
+
+func (t *failingTransport) send(_ context.Context, p *payload) (io.ReadCloser, error) {
+	t.Lock()
+	defer t.Unlock()
+	t.traces = append(t.traces, nil)
+	return nil, errors.New("agent unreachable")
+}
+
+func TestAgentWriterCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	transport := &failingTransport{}
+	var tg testStatsdClient
+	c := newConfig(withTransport(transport), withStatsdClient(&tg))
+	h := newAgentTraceWriter(c, newPrioritySampler())
+
+	for i := 0; i < breakerFailureThreshold+2; i++ {
+		h.add([]*span{makeSpan(0)})
+		h.flush()
+		h.wg.Wait()
+	}
+	assert.True(h.breaker.isOpen())
+	assert.Equal(breakerFailureThreshold, transport.Len())
+	assert.Contains(tg.CallNames(), "datadog.tracer.circuit_breaker.opened")
+	assert.Equal(0, h.payload.itemCount())
+}
@@ -7,15 +7,24 @@ package tracer
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/internal"
+	"gopkg.in/DataDog/dd-trace-go.v1/internal/samplernames"
 )
 
 type contextKey struct{}
 
 var activeSpanKey = contextKey{}
 
+type spanContextKey struct{}
+
+type sharedSamplingKey struct{}
+
 // ContextWithSpan returns a copy of the given context which includes the span s.
 func ContextWithSpan(ctx context.Context, s Span) context.Context {
 	return context.WithValue(ctx, activeSpanKey, s)
@@ -35,20 +44,212 @@ func SpanFromContext(ctx context.Context) (Span, bool) {
 	return &internal.NoopSpan{}, false
 }
 
+// ContextWithSpanContext returns a copy of the given context which includes a
+// copy of the span context sc. Only the values needed to start descendant spans
+// are kept: the trace and span IDs, the sampling priority, the origin and the
+// baggage. Unlike ContextWithSpan, the returned context holds no reference to the
+// span, so it can be passed across asynchronous boundaries where the span may
+// finish before descendants are started.
+func ContextWithSpanContext(ctx context.Context, sc ddtrace.SpanContext) context.Context {
+	if c, ok := sc.(*spanContext); ok {
+		sc = c.detached()
+	}
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// GoContext returns a context to be passed to a goroutine which may outlive the
+// span contained in ctx, such as background work started while handling a request:
+//
+//	go func(ctx context.Context) {
+//		span, ctx := tracer.StartSpanFromContext(ctx, "async.work")
+//		defer span.Finish()
+//		// ...
+//	}(tracer.GoContext(ctx))
+//
+// Spans started from the returned context are children of the span in ctx, as with
+// ContextWithSpanContext, but hold no reference to it, so they are sent as expected
+// even when it finished long before. The returned context keeps the values of ctx,
+// but not its deadline nor its cancellation, since they usually end with the request.
+func GoContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	d := detachedContext{parent: ctx}
+	if sc, ok := lookupSpanContext(ctx); ok {
+		return ContextWithSpanContext(d, sc)
+	}
+	return d
+}
+
+// detachedContext is a context holding the values of its parent, except for the
+// active span, without its deadline and cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) { return }
+
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+func (detachedContext) Err() error { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	if key == activeSpanKey {
+		return nil
+	}
+	return c.parent.Value(key)
+}
+
+// SpanContextFromContext returns the context of the span contained in the given
+// context or, if there is none, the span context stored using ContextWithSpanContext.
+// A second return value indicates if a span context was found.
+func SpanContextFromContext(ctx context.Context) (ddtrace.SpanContext, bool) {
+	sc, ok := lookupSpanContext(ctx)
+	if c, isOurs := sc.(*spanContext); isOurs && !c.local() {
+		// the span context was stored using ContextWithSpanContext; each descendant
+		// gets its own trace buffer, as it may be used to start spans in several goroutines
+		sc = c.detached()
+	}
+	return sc, ok
+}
+
+// lookupSpanContext returns the context of the span contained in ctx or, if there
+// is none, the stored span context as is. Unlike SpanContextFromContext, it does
+// not allocate.
+func lookupSpanContext(ctx context.Context) (ddtrace.SpanContext, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	if s, ok := ctx.Value(activeSpanKey).(ddtrace.Span); ok {
+		return s.Context(), true
+	}
+	sc, ok := ctx.Value(spanContextKey{}).(ddtrace.SpanContext)
+	return sc, ok
+}
+
+// TraceIDFromContext returns the ID of the trace of the span contained in the given
+// context or, if there is none, of the span context stored using ContextWithSpanContext.
+// A second return value indicates if an ID was found. It is meant for correlating
+// logs with traces: it does not allocate and is safe to call with a nil context.
+func TraceIDFromContext(ctx context.Context) (uint64, bool) {
+	sc, ok := lookupSpanContext(ctx)
+	if !ok {
+		return 0, false
+	}
+	return sc.TraceID(), true
+}
+
+// SpanIDFromContext returns the ID of the span contained in the given context or,
+// if there is none, of the span context stored using ContextWithSpanContext.
+// A second return value indicates if an ID was found. It is meant for correlating
+// logs with traces: it does not allocate and is safe to call with a nil context.
+func SpanIDFromContext(ctx context.Context) (uint64, bool) {
+	sc, ok := lookupSpanContext(ctx)
+	if !ok {
+		return 0, false
+	}
+	return sc.SpanID(), true
+}
+
+// ContextWithSharedSampling returns a copy of the given context in which all the
+// root spans started from it, or from contexts derived from it, share a single
+// sampling decision: the one made for the first of them. This keeps sampling
+// consistent for a request which starts several independent traces, such as a
+// batch of jobs. Spans which have a parent keep inheriting its decision.
+func ContextWithSharedSampling(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sharedSamplingKey{}, new(sharedSampling))
+}
+
+// sharedSamplingFromContext returns the sampling decision shared by the root spans
+// started from ctx, if any.
+func sharedSamplingFromContext(ctx context.Context) (*sharedSampling, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	ss, ok := ctx.Value(sharedSamplingKey{}).(*sharedSampling)
+	return ss, ok
+}
+
+// sharedSampling holds a sampling decision shared by several root spans.
+type sharedSampling struct {
+	mu       sync.Mutex
+	decided  bool
+	dropped  bool               // the trace was dropped by the sampler
+	priority *int               // the sampling priority, if one was set
+	dm       string             // the decision maker propagating tag
+	metrics  map[string]float64 // the sampling rates set on the span
+}
+
+// sharedSamplingMetrics holds the keys of the span metrics describing how a
+// sampling decision was made.
+var sharedSamplingMetrics = []string{
+	keySamplingPriorityRate,
+	keyRulesSamplerAppliedRate,
+	keyRulesSamplerLimiterRate,
+	sampleRateMetricKey,
+}
+
+// sample applies the shared sampling decision to the root span s, using t to make
+// the decision if this has not been done yet.
+func (ss *sharedSampling) sample(t *tracer, s *span) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	trace := s.context.trace
+	if !ss.decided {
+		t.sample(s)
+		ss.decided = true
+		ss.dropped = samplingDecision(atomic.LoadUint32((*uint32)(&trace.samplingDecision))) == decisionDrop
+		if p, ok := trace.samplingPriority(); ok {
+			ss.priority = &p
+		}
+		trace.mu.RLock()
+		ss.dm = trace.propagatingTags[keyDecisionMaker]
+		trace.mu.RUnlock()
+		for _, k := range sharedSamplingMetrics {
+			if v, ok := s.Metrics[k]; ok {
+				if ss.metrics == nil {
+					ss.metrics = make(map[string]float64, len(sharedSamplingMetrics))
+				}
+				ss.metrics[k] = v
+			}
+		}
+		return
+	}
+	if ss.dropped {
+		trace.drop()
+	}
+	if ss.priority != nil {
+		s.setSamplingPriorityLocked(*ss.priority, samplernames.Unknown)
+		if ss.dm != "" {
+			trace.setPropagatingTag(keyDecisionMaker, ss.dm)
+		}
+	}
+	for k, v := range ss.metrics {
+		s.setMetric(k, v)
+	}
+}
+
 // StartSpanFromContext returns a new span with the given operation name and options. If a span
-// is found in the context, it will be used as the parent of the resulting span. If the ChildOf
-// option is passed, it will only be used as the parent if there is no span found in `ctx`.
+// is found in the context, it will be used as the parent of the resulting span. Otherwise, a span
+// context stored using ContextWithSpanContext is used as the parent. If the ChildOf option is
+// passed, it will only be used as the parent if there is no span or span context found in `ctx`.
 func StartSpanFromContext(ctx context.Context, operationName string, opts ...StartSpanOption) (Span, context.Context) {
+	if ctx == nil {
+		// default to context.Background() to avoid panics on Go >= 1.15
+		ctx = context.Background()
+	}
+	if _, ok := internal.GetGlobalTracer().(*internal.NoopTracer); ok {
+		// tracing is disabled; skip preparing the options of a span which records nothing
+		var s Span = internal.NoopSpan{}
+		return s, ContextWithSpan(ctx, s)
+	}
 	// copy opts in case the caller reuses the slice in parallel
 	// we will add at least 1, at most 2 items
 	optsLocal := make([]StartSpanOption, len(opts), len(opts)+2)
 	copy(optsLocal, opts)
 
-	if ctx == nil {
-		// default to context.Background() to avoid panics on Go >= 1.15
-		ctx = context.Background()
-	} else if s, ok := SpanFromContext(ctx); ok {
-		optsLocal = append(optsLocal, ChildOf(s.Context()))
+	if sc, ok := SpanContextFromContext(ctx); ok {
+		optsLocal = append(optsLocal, ChildOf(sc))
 	}
 	optsLocal = append(optsLocal, withContext(ctx))
 	s := StartSpan(operationName, optsLocal...)
@@ -60,3 +261,50 @@ func StartSpanFromContext(ctx context.Context, operationName string, opts ...Sta
 	}
 	return s, ContextWithSpan(ctx, s)
 }
+
+// RecordEvent records an instantaneous event, such as a significant moment in the
+// handling of a request, as a span of zero duration named after the event and
+// carrying the given tags. If a span or span context is found in ctx, the event is
+// recorded as its child; otherwise it is a trace of its own. An empty service
+// leaves the default service of the tracer.
+func RecordEvent(ctx context.Context, name, service string, tags map[string]string) {
+	now := time.Now()
+	opts := make([]StartSpanOption, 0, len(tags)+2)
+	opts = append(opts, StartTime(now))
+	if service != "" {
+		opts = append(opts, ServiceName(service))
+	}
+	for k, v := range tags {
+		opts = append(opts, Tag(k, v))
+	}
+	s, _ := StartSpanFromContext(ctx, name, opts...)
+	s.Finish(FinishTime(now))
+}
+
+// RecoverAndFlush ensures that traces are not lost when a goroutine panics. It
+// is meant to be deferred at the top of the goroutine, after the span found in
+// ctx was started:
+//
+//	span, ctx := tracer.StartSpanFromContext(ctx, "job.run")
+//	defer span.Finish()
+//	defer tracer.RecoverAndFlush(ctx)
+//
+// When recovering a panic, the span in ctx is finished with the panic as its
+// error, all finished traces are sent to the agent and the panic is then resumed.
+// Since only complete traces are sent, the span should be the root of its trace.
+// RecoverAndFlush has no effect when there is no panic.
+func RecoverAndFlush(ctx context.Context) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if s, ok := SpanFromContext(ctx); ok {
+		err, ok := r.(error)
+		if !ok {
+			err = fmt.Errorf("%v", r)
+		}
+		s.Finish(WithError(err))
+	}
+	Flush()
+	panic(r)
+}
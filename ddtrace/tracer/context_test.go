@@ -11,6 +11,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/internal"
 )
 
@@ -45,6 +46,155 @@ func TestSpanFromContext(t *testing.T) {
 	})
 }
 
+func TestSpanContextFromContext(t *testing.T) {
+	_, _, _, stop := startTestTracer(t)
+	defer stop()
+
+	t.Run("span", func(t *testing.T) {
+		assert := assert.New(t)
+		root := StartSpan("root").(*span)
+		defer root.Finish()
+		// a live span takes precedence over a stored span context
+		ctx := ContextWithSpanContext(context.Background(), &spanContext{spanID: 1, traceID: 2})
+		ctx = ContextWithSpan(ctx, root)
+		sc, ok := SpanContextFromContext(ctx)
+		assert.True(ok)
+		assert.Equal(root.context, sc)
+	})
+
+	t.Run("span-context", func(t *testing.T) {
+		assert := assert.New(t)
+		root := StartSpan("root", Origin("synthetics")).(*span)
+		root.SetBaggageItem("key", "value")
+		root.SetTag(ext.SamplingPriority, ext.PriorityUserKeep)
+		ctx := ContextWithSpanContext(context.Background(), root.Context())
+		root.Finish()
+
+		sc, ok := SpanContextFromContext(ctx)
+		assert.True(ok)
+		got := sc.(*spanContext)
+		assert.Nil(got.span)
+		assert.NotEqual(root.context.trace, got.trace)
+		assert.Equal(root.TraceID, got.TraceID())
+		assert.Equal(root.SpanID, got.SpanID())
+		assert.Equal("synthetics", got.origin)
+		assert.Equal("value", got.baggageItem("key"))
+		p, ok := got.samplingPriority()
+		assert.True(ok)
+		assert.Equal(ext.PriorityUserKeep, p)
+		assert.Equal(root.context.trace.propagatingTags[keyDecisionMaker], got.trace.propagatingTags[keyDecisionMaker])
+	})
+
+	t.Run("none", func(t *testing.T) {
+		assert := assert.New(t)
+		sc, ok := SpanContextFromContext(context.Background())
+		assert.False(ok)
+		assert.Nil(sc)
+		sc, ok = SpanContextFromContext(nil)
+		assert.False(ok)
+		assert.Nil(sc)
+	})
+}
+
+func TestStartSpanFromSpanContext(t *testing.T) {
+	_, transport, flush, stop := startTestTracer(t)
+	defer stop()
+	assert := assert.New(t)
+
+	root := StartSpan("root").(*span)
+	root.SetBaggageItem("key", "value")
+	root.SetTag(ext.SamplingPriority, ext.PriorityUserReject)
+	ctx := ContextWithSpanContext(context.Background(), root.Context())
+	root.Finish()
+
+	// descendants started after the parent finished
+	for i := 0; i < 2; i++ {
+		child, _ := StartSpanFromContext(ctx, "child")
+		got := child.(*span)
+		assert.Equal(root.TraceID, got.TraceID)
+		assert.Equal(root.SpanID, got.ParentID)
+		assert.Equal("value", got.context.baggageItem("key"))
+		p, ok := got.context.samplingPriority()
+		assert.True(ok)
+		assert.Equal(ext.PriorityUserReject, p)
+		child.Finish()
+	}
+	flush(3)
+	assert.Len(transport.Traces(), 3)
+}
+
+func TestGoContext(t *testing.T) {
+	_, transport, flush, stop := startTestTracer(t)
+	defer stop()
+	assert := assert.New(t)
+
+	type valueKey struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), valueKey{}, "value"))
+	root, ctx := StartSpanFromContext(ctx, "web.request")
+	gctx := GoContext(ctx)
+
+	// the request ends before the goroutine starts its span
+	root.Finish()
+	cancel()
+	flush(1)
+
+	done := make(chan struct{})
+	go func(ctx context.Context) {
+		defer close(done)
+		assert.NoError(ctx.Err())
+		assert.Equal("value", ctx.Value(valueKey{}))
+		_, ok := ctx.Value(activeSpanKey).(Span)
+		assert.False(ok)
+		child, _ := StartSpanFromContext(ctx, "async.work")
+		assert.Equal(root.(*span).TraceID, child.(*span).TraceID)
+		assert.Equal(root.(*span).SpanID, child.(*span).ParentID)
+		child.Finish()
+	}(gctx)
+	<-done
+	flush(2)
+	assert.Equal("async.work", transport.Traces()[1][0].Name)
+
+	assert.Equal(context.Background(), GoContext(nil))
+	_, ok := SpanContextFromContext(GoContext(context.Background()))
+	assert.False(ok)
+}
+
+func TestIDsFromContext(t *testing.T) {
+	assert := assert.New(t)
+	live := &span{context: &spanContext{spanID: 1, traceID: 2}}
+	stored := &spanContext{spanID: 3, traceID: 4}
+	for _, tt := range []struct {
+		ctx     context.Context
+		traceID uint64
+		spanID  uint64
+		ok      bool
+	}{
+		{ctx: ContextWithSpan(context.Background(), live), traceID: 2, spanID: 1, ok: true},
+		{ctx: ContextWithSpanContext(context.Background(), stored), traceID: 4, spanID: 3, ok: true},
+		{ctx: ContextWithSpan(ContextWithSpanContext(context.Background(), stored), live), traceID: 2, spanID: 1, ok: true},
+		{ctx: context.Background()},
+		{ctx: nil},
+	} {
+		traceID, ok := TraceIDFromContext(tt.ctx)
+		assert.Equal(tt.ok, ok)
+		assert.Equal(tt.traceID, traceID)
+		spanID, ok := SpanIDFromContext(tt.ctx)
+		assert.Equal(tt.ok, ok)
+		assert.Equal(tt.spanID, spanID)
+	}
+
+	for _, ctx := range []context.Context{
+		ContextWithSpan(context.Background(), live),
+		ContextWithSpanContext(context.Background(), stored),
+	} {
+		allocs := testing.AllocsPerRun(100, func() {
+			TraceIDFromContext(ctx)
+			SpanIDFromContext(ctx)
+		})
+		assert.Zero(allocs)
+	}
+}
+
 func TestStartSpanFromContext(t *testing.T) {
 	_, _, _, stop := startTestTracer(t)
 	defer stop()
@@ -76,6 +226,83 @@ func TestStartSpanFromContext(t *testing.T) {
 	assert.Equal("/", got.Resource)
 }
 
+func TestStartSpanFromContextTags(t *testing.T) {
+	type tenantKey struct{}
+	_, _, _, stop := startTestTracer(t, WithContextTags(func(ctx context.Context) map[string]string {
+		tenant, ok := ctx.Value(tenantKey{}).(string)
+		if !ok {
+			return nil
+		}
+		return map[string]string{"tenant": tenant, "team": "core"}
+	}))
+	defer stop()
+	assert := assert.New(t)
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+	root, ctx := StartSpanFromContext(ctx, "http.request", Tag("team", "web"))
+	child, _ := StartSpanFromContext(ctx, "db.query")
+	assert.Equal("acme", root.(*span).Meta["tenant"])
+	// explicit tags take precedence
+	assert.Equal("web", root.(*span).Meta["team"])
+	assert.Equal("acme", child.(*span).Meta["tenant"])
+	assert.Equal("core", child.(*span).Meta["team"])
+
+	// spans not started from a context are left alone
+	other := StartSpan("other")
+	assert.NotContains(other.(*span).Meta, "tenant")
+	other, _ = StartSpanFromContext(context.Background(), "other")
+	assert.NotContains(other.(*span).Meta, "tenant")
+}
+
+func TestContextWithSharedSampling(t *testing.T) {
+	_, _, _, stop := startTestTracer(t, WithSamplingRules([]SamplingRule{RateRule(0.5)}))
+	defer stop()
+	assert := assert.New(t)
+
+	decisions := make(map[int]int)
+	for i := 0; i < 50; i++ {
+		ctx := ContextWithSharedSampling(context.Background())
+		first, _ := StartSpanFromContext(ctx, "job.run")
+		p, ok := first.(*span).context.samplingPriority()
+		assert.True(ok)
+		decisions[p]++
+		for j := 0; j < 3; j++ {
+			root, rctx := StartSpanFromContext(ctx, "job.run")
+			child, _ := StartSpanFromContext(rctx, "db.query")
+			assert.NotEqual(first.(*span).TraceID, root.(*span).TraceID)
+			for _, s := range []*span{root.(*span), child.(*span)} {
+				sp, ok := s.context.samplingPriority()
+				assert.True(ok)
+				assert.Equal(p, sp)
+				assert.Equal(first.(*span).Metrics[keyRulesSamplerAppliedRate], s.context.trace.root.Metrics[keyRulesSamplerAppliedRate])
+			}
+		}
+	}
+	// the decisions still vary between contexts
+	assert.Len(decisions, 2)
+}
+
+func TestStartSpanDisabledAllocs(t *testing.T) {
+	internal.SetGlobalTracer(&internal.NoopTracer{})
+	ctx := context.Background()
+	allocs := testing.AllocsPerRun(100, func() {
+		s := StartSpan("op")
+		s.SetTag("key", "value")
+		s.Finish()
+	})
+	assert.Zero(t, allocs)
+	allocs = testing.AllocsPerRun(100, func() {
+		s, _ := StartSpanFromContext(ctx, "op")
+		s.Finish()
+	})
+	// only the returned context is allocated
+	assert.Equal(t, 1.0, allocs)
+	s, sctx := StartSpanFromContext(ctx, "op")
+	assert.Equal(t, internal.NoopSpan{}, s)
+	_, ok := SpanFromContext(sctx)
+	assert.True(t, ok)
+}
+
 func TestStartSpanFromContextRace(t *testing.T) {
 	_, _, _, stop := startTestTracer(t)
 	defer stop()
@@ -125,3 +352,71 @@ func TestStartSpanFromNilContext(t *testing.T) {
 	assert.True(ok)
 	assert.Equal(child, ctxSpan)
 }
+
+func TestRecoverAndFlush(t *testing.T) {
+	t.Run("panic", func(t *testing.T) {
+		assert := assert.New(t)
+		_, transport, _, stop := startTestTracer(t)
+		defer stop()
+
+		var recovered interface{}
+		func() {
+			defer func() { recovered = recover() }()
+			span, ctx := StartSpanFromContext(context.Background(), "job.run")
+			defer span.Finish()
+			defer RecoverAndFlush(ctx)
+			panic("boom")
+		}()
+		assert.Equal("boom", recovered, "panic should be resumed")
+
+		traces := transport.Traces()
+		assert.Len(traces, 1)
+		assert.Len(traces[0], 1)
+		assert.EqualValues(1, traces[0][0].Error)
+		assert.Equal("boom", traces[0][0].Meta[ext.ErrorMsg])
+	})
+
+	t.Run("no-panic", func(t *testing.T) {
+		assert := assert.New(t)
+		_, transport, _, stop := startTestTracer(t)
+		defer stop()
+
+		func() {
+			span, ctx := StartSpanFromContext(context.Background(), "job.run")
+			defer span.Finish()
+			defer RecoverAndFlush(ctx)
+		}()
+		assert.Equal(0, transport.Len(), "should not flush")
+	})
+}
+
+func TestRecordEvent(t *testing.T) {
+	assert := assert.New(t)
+	_, transport, flush, stop := startTestTracer(t)
+	defer stop()
+
+	root, ctx := StartSpanFromContext(context.Background(), "http.request")
+	RecordEvent(ctx, "cache.miss", "cache", map[string]string{"key": "users"})
+	root.Finish()
+	RecordEvent(nil, "deploy", "", nil)
+	flush(2)
+
+	traces := transport.Traces()
+	assert.Len(traces, 2)
+	var event *span
+	for _, s := range traces[0] {
+		if s.Name == "cache.miss" {
+			event = s
+		}
+	}
+	if assert.NotNil(event) {
+		assert.Equal(root.(*span).SpanID, event.ParentID)
+		assert.Equal("cache", event.Service)
+		assert.Equal("users", event.Meta["key"])
+		assert.Zero(event.Duration)
+		assert.NotZero(event.Start)
+	}
+	assert.Equal("deploy", traces[1][0].Name)
+	assert.Zero(traces[1][0].ParentID)
+	assert.Zero(traces[1][0].Duration)
+}
@@ -70,6 +70,18 @@
 // spans that inherit from it. Thus, a child span is created from a span's span context.
 // The span context can originate from within the same process, but also a
 // different process or even a different machine in the case of distributed tracing.
+// A span context remains valid after its span has finished, so it is safe to pass
+// it on to work which outlives the span, such as a background goroutine. Spans started
+// from it using ChildOf belong to the same trace, regardless of which finishes first:
+//	sctx := span.Context()
+//	go func() {
+//		child := tracer.StartSpan("background.job", tracer.ChildOf(sctx))
+//		defer child.Finish()
+//		// ...
+//	}()
+//	span.Finish()
+//
+// This does not hold when span pooling is enabled, see WithSpanPooling.
 //
 // To make use of distributed tracing, a span's context may be injected via a carrier
 // into a transport (HTTP, RPC, etc.) to be extracted on the other end and used to
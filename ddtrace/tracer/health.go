@@ -0,0 +1,85 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016 Datadog, Inc.
+
+package tracer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/internal"
+)
+
+var (
+	// healthCheckTimeout specifies how long a health check waits for the agent.
+	healthCheckTimeout = time.Second
+
+	// healthCheckCacheDuration specifies how long the result of a health check is
+	// reused for before the agent is queried again; replaced in tests.
+	healthCheckCacheDuration = 5 * time.Second
+)
+
+// errNotStarted is returned by Healthy when the tracer is not started.
+var errNotStarted = errors.New("tracer not started")
+
+// Healthy reports whether the started tracer is able to reach the Datadog Agent.
+// It returns nil if the agent responded, or the reason for which it did not. It
+// is meant to be used by readiness probes: the agent is queried with a short
+// timeout and the result is reused for a few seconds. Sending traces is not
+// affected by calls to Healthy.
+func Healthy() error {
+	t, ok := internal.GetGlobalTracer().(*tracer)
+	if !ok {
+		return errNotStarted
+	}
+	return t.health.check(t.config)
+}
+
+// healthChecker queries the agent and caches the result.
+type healthChecker struct {
+	mu      sync.Mutex // guards below fields
+	checked time.Time  // time of the last check
+	err     error      // result of the last check
+}
+
+func (h *healthChecker) check(c *config) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.checked.IsZero() && time.Since(h.checked) < healthCheckCacheDuration {
+		return h.err
+	}
+	h.err = pingAgent(c)
+	h.checked = time.Now()
+	return h.err
+}
+
+// pingAgent queries the agent's /info endpoint. Agents which predate it respond
+// with 404, which also shows that they are reachable.
+func pingAgent(c *config) error {
+	if c.logToStdout {
+		// there is no agent
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/info", c.agentAddr), nil)
+	if err != nil {
+		return err
+	}
+	c.setHTTPHeaders(req)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("agent responded with %s", resp.Status)
+	}
+	return nil
+}
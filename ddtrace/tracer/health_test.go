@@ -0,0 +1,65 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016 Datadog, Inc.
+
+package tracer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthy(t *testing.T) {
+	t.Run("not-started", func(t *testing.T) {
+		assert.Equal(t, errNotStarted, Healthy())
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		assert := assert.New(t)
+		var hits int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/info" {
+				atomic.AddInt32(&hits, 1)
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer srv.Close()
+		u, err := url.Parse(srv.URL)
+		assert.NoError(err)
+
+		Start(WithAgentAddr(u.Host), withNoopStats(), WithLogStartup(false))
+		defer Stop()
+		startHits := atomic.LoadInt32(&hits) // the tracer queries /info when starting
+		assert.NoError(Healthy())
+		assert.NoError(Healthy())
+		assert.Equal(startHits+1, atomic.LoadInt32(&hits), "result should be cached")
+	})
+
+	t.Run("error", func(t *testing.T) {
+		assert := assert.New(t)
+		defer func(old time.Duration) { healthCheckCacheDuration = old }(healthCheckCacheDuration)
+		healthCheckCacheDuration = 0
+		var status int32 = http.StatusServiceUnavailable
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+		}))
+		defer srv.Close()
+		u, err := url.Parse(srv.URL)
+		assert.NoError(err)
+
+		Start(WithAgentAddr(u.Host), withNoopStats(), WithLogStartup(false))
+		defer Stop()
+		assert.EqualError(Healthy(), "agent responded with 503 Service Unavailable")
+		atomic.StoreInt32(&status, http.StatusOK)
+		assert.NoError(Healthy())
+		srv.Close()
+		assert.Error(Healthy())
+	})
+}
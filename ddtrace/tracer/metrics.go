@@ -102,6 +102,21 @@ func (t *tracer) reportHealthMetrics(interval time.Duration) {
 			t.config.statsd.Count("datadog.tracer.spans_started", int64(atomic.SwapUint32(&t.spansStarted, 0)), nil, 1)
 			t.config.statsd.Count("datadog.tracer.spans_finished", int64(atomic.SwapUint32(&t.spansFinished, 0)), nil, 1)
 			t.config.statsd.Count("datadog.tracer.traces_dropped", int64(atomic.SwapUint32(&t.tracesDropped, 0)), []string{"reason:trace_too_large"}, 1)
+			t.config.statsd.Count("datadog.tracer.traces_dropped", int64(atomic.SwapUint32(&t.tracesQueueFull, 0)), []string{"reason:queue_full"}, 1)
+			t.config.statsd.Count("datadog.tracer.traces_dropped", int64(atomic.SwapUint32(&t.tracesShed, 0)), []string{"reason:max_buffered_spans"}, 1)
+			t.config.statsd.Count("datadog.tracer.traces_dropped", int64(atomic.SwapUint32(&t.tracesIgnored, 0)), []string{"reason:ignored_resource"}, 1)
+			t.config.statsd.Count("datadog.tracer.spans_filtered", int64(atomic.SwapUint32(&t.spansFiltered, 0)), nil, 1)
+			t.config.statsd.Count("datadog.tracer.spans_dropped", int64(atomic.SwapUint32(&t.spansServiceDisabled, 0)), []string{"reason:service_disabled"}, 1)
+			if w, ok := t.traceWriter.(*agentTraceWriter); ok {
+				var open float64
+				if w.breaker.isOpen() {
+					open = 1
+				}
+				t.config.statsd.Gauge("datadog.tracer.circuit_breaker.open", open, nil, 1)
+			}
+			if s, ok := t.config.sampler.(AdaptiveSampler); ok {
+				t.config.statsd.Gauge("datadog.tracer.adaptive_sampler.rate", s.Rate(), nil, 1)
+			}
 		case <-t.stop:
 			return
 		}
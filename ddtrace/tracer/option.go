@@ -9,6 +9,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"net"
 	"net/http"
@@ -59,6 +60,10 @@ type config struct {
 	// output instead of using the agent. This is used in Lambda environments.
 	logToStdout bool
 
+	// traceOutput, when set, replaces the standard output as the destination of
+	// traces when logToStdout is true.
+	traceOutput io.Writer
+
 	// logStartup, when true, causes various startup info to be written
 	// when the tracer starts.
 	logStartup bool
@@ -90,6 +95,23 @@ type config struct {
 	// all spans.
 	globalTags map[string]interface{}
 
+	// httpHeaders and httpHeadersFunc provide headers which are set on every
+	// request sent to the agent.
+	httpHeaders     map[string]string
+	httpHeadersFunc func() map[string]string
+
+	// clockSync specifies whether span start times are corrected by the offset
+	// between the local clock and the agent's clock.
+	clockSync bool
+
+	// traceSummary specifies whether the local root span of every trace sent is
+	// tagged with aggregates of the trace, see WithTraceSummary.
+	traceSummary bool
+
+	// flushTags, when set, returns tags which are set on the first span of every
+	// trace when it is sent.
+	flushTags func() map[string]string
+
 	// transport specifies the Transport interface which will be used to send data to the agent.
 	transport transport
 
@@ -99,6 +121,11 @@ type config struct {
 	// httpClient specifies the HTTP client to be used by the agent's transport.
 	httpClient *http.Client
 
+	// maxIdleConns and idleConnTimeout tune the connection pool of httpClient,
+	// when non-zero.
+	maxIdleConns    int
+	idleConnTimeout time.Duration
+
 	// hostname is automatically assigned when the DD_TRACE_REPORT_HOSTNAME is set to true,
 	// and is added as a special tag to the root span of traces.
 	hostname string
@@ -118,6 +145,27 @@ type config struct {
 	// statsd is used for tracking metrics associated with the runtime and the tracer.
 	statsd statsdClient
 
+	// spanPooling specifies whether spans are reused once they were sent.
+	spanPooling bool
+
+	// contextTags, when set, returns tags to set on spans started from a context.
+	contextTags func(ctx context.Context) map[string]string
+
+	// inheritedTags holds the keys of the tags copied from a parent span to its
+	// children when they are started.
+	inheritedTags []string
+
+	// spanFilter, when set, reports whether a finished span should be dropped.
+	spanFilter func(Span) bool
+
+	// spanProcessors holds the span processors registered using WithSpanProcessor,
+	// in registration order.
+	spanProcessors []SpanProcessor
+
+	// flushCallback, when set, is called with the result of every attempt to send
+	// a payload of traces to the agent.
+	flushCallback func(FlushResult)
+
 	// spanRules contains user-defined rules to determine the sampling rate to apply
 	// to trace spans.
 	spanRules []SamplingRule
@@ -126,10 +174,57 @@ type config struct {
 	// to individual spans.
 	traceRules []SamplingRule
 
+	// flushHighWatermark specifies the number of buffered spans which triggers a flush
+	// ahead of the regular flush interval. Zero disables it.
+	flushHighWatermark int
+
+	// overflowPolicy specifies which traces are dropped when the payload queue is full.
+	overflowPolicy OverflowPolicy
+
+	// spanRuntimeMetricsRate specifies the fraction of root spans on which a
+	// snapshot of runtime metrics is set. Zero disables it.
+	spanRuntimeMetricsRate float64
+
+	// maxTagValueLength specifies the maximum length of tag values set using
+	// SetTag. Zero means no limit.
+	maxTagValueLength int
+
+	// queueSize specifies the capacity of the queue of finished traces waiting for
+	// the worker. Zero means payloadQueueSize.
+	queueSize int
+
+	// maxBufferedSpans specifies the maximum number of finished spans held by the
+	// tracer until they are sent. Zero means no limit.
+	maxBufferedSpans int
+
+	// maxSpansPerTrace specifies the maximum number of spans recorded for a single
+	// trace. Zero means no limit.
+	maxSpansPerTrace int
+
+	// noKeepErrors disables keeping the traces which contain errors regardless of
+	// the sampling decision.
+	noKeepErrors bool
+
 	// tickChan specifies a channel which will receive the time every time the tracer must flush.
 	// It defaults to time.Ticker; replaced in tests.
 	tickChan <-chan time.Time
 
+	// noWorker specifies that no background worker is started, leaving it to the
+	// caller to flush traces using Flush.
+	noWorker bool
+
+	// captureCaller specifies whether the file:line at which spans are started is
+	// recorded on them.
+	captureCaller bool
+
+	// ratesPollInterval, when positive, specifies the interval at which the agent's
+	// sampling rates are polled while no traces are being sent.
+	ratesPollInterval time.Duration
+
+	// resourceObfuscator, when set, is applied to the resource of every span
+	// as it finishes.
+	resourceObfuscator func(resource string) string
+
 	// noDebugStack disables the collection of debug stack traces globally. No traces reporting
 	// errors will record a stack trace when this option is set.
 	noDebugStack bool
@@ -190,6 +285,7 @@ func newConfig(opts ...StartOption) *config {
 	c.sampler = NewAllSampler()
 	c.agentAddr = resolveAgentAddr()
 	c.httpClient = defaultHTTPClient()
+	c.maxTagValueLength = defaultMaxTagValueLength
 
 	if internal.BoolEnv("DD_TRACE_ANALYTICS_ENABLED", false) {
 		globalconfig.SetAnalyticsRate(1.0)
@@ -230,6 +326,9 @@ func newConfig(opts ...StartOption) *config {
 		// See: https://docs.aws.amazon.com/lambda/latest/dg/configuration-envvars.html
 		c.logToStdout = true
 	}
+	if internal.BoolEnv("DD_TRACE_TO_STDOUT", false) {
+		c.logToStdout = true
+	}
 	c.logStartup = internal.BoolEnv("DD_TRACE_STARTUP_LOGS", true)
 	c.runtimeMetrics = internal.BoolEnv("DD_RUNTIME_METRICS_ENABLED", false)
 	c.debug = internal.BoolEnv("DD_TRACE_DEBUG", false)
@@ -265,8 +364,15 @@ func newConfig(opts ...StartOption) *config {
 			c.serviceName = filepath.Base(os.Args[0])
 		}
 	}
+	if c.maxIdleConns > 0 || c.idleConnTimeout > 0 {
+		c.httpClient = tuneHTTPClient(c.httpClient, c.maxIdleConns, c.idleConnTimeout)
+	}
 	if c.transport == nil {
-		c.transport = newHTTPTransport(c.agentAddr, c.httpClient)
+		t := newHTTPTransport(c.agentAddr, c.httpClient)
+		if c.httpHeaders != nil || c.httpHeadersFunc != nil {
+			t.setHeaders = c.setHTTPHeaders
+		}
+		c.transport = t
 	}
 	if c.propagator == nil {
 		envKey := "DD_TRACE_X_DATADOG_TAGS_MAX_LENGTH"
@@ -290,6 +396,9 @@ func newConfig(opts ...StartOption) *config {
 		log.SetLevel(log.LevelDebug)
 	}
 	c.loadAgentFeatures()
+	if t, ok := c.transport.(*httpTransport); ok && c.agent.legacyTraces {
+		t.useLegacyEndpoint()
+	}
 	if c.statsd == nil {
 		// configure statsd client
 		addr := c.dogstatsdAddr
@@ -343,6 +452,7 @@ func udsClient(socketPath string) *http.Client {
 				}).String())
 			},
 			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   100,
 			IdleConnTimeout:       90 * time.Second,
 			TLSHandshakeTimeout:   10 * time.Second,
 			ExpectContinueTimeout: 1 * time.Second,
@@ -351,6 +461,29 @@ func udsClient(socketPath string) *http.Client {
 	}
 }
 
+// tuneHTTPClient returns a copy of the given client with its connection pool
+// tuned to keep up to maxIdle idle connections for the given timeout. Zero values
+// are left unchanged. Only clients using an *http.Transport can be tuned.
+func tuneHTTPClient(client *http.Client, maxIdle int, timeout time.Duration) *http.Client {
+	tr, ok := client.Transport.(*http.Transport)
+	if !ok {
+		log.Warn("Unable to tune the connection pool of an HTTP client using %T.", client.Transport)
+		return client
+	}
+	tr = tr.Clone()
+	if maxIdle > 0 {
+		// all connections go to the agent
+		tr.MaxIdleConns = maxIdle
+		tr.MaxIdleConnsPerHost = maxIdle
+	}
+	if timeout > 0 {
+		tr.IdleConnTimeout = timeout
+	}
+	tuned := *client
+	tuned.Transport = tr
+	return &tuned
+}
+
 // defaultDogstatsdAddr returns the default connection address for Dogstatsd.
 func defaultDogstatsdAddr() string {
 	envHost, envPort := os.Getenv("DD_AGENT_HOST"), os.Getenv("DD_DOGSTATSD_PORT")
@@ -386,6 +519,10 @@ type agentFeatures struct {
 
 	// featureFlags specifies all the feature flags reported by the trace-agent.
 	featureFlags map[string]struct{}
+
+	// legacyTraces reports whether the agent only accepts traces on the
+	// /v0.3/traces endpoint.
+	legacyTraces bool
 }
 
 // HasFlag reports whether the agent has set the feat feature flag.
@@ -394,6 +531,20 @@ func (a *agentFeatures) HasFlag(feat string) bool {
 	return ok
 }
 
+// setHTTPHeaders sets the headers provided using WithHTTPHeaders and
+// WithHTTPHeadersFunc on req.
+func (c *config) setHTTPHeaders(req *http.Request) {
+	for k, v := range c.httpHeaders {
+		req.Header.Set(k, v)
+	}
+	if c.httpHeadersFunc == nil {
+		return
+	}
+	for k, v := range c.httpHeadersFunc() {
+		req.Header.Set(k, v)
+	}
+}
+
 // loadAgentFeatures queries the trace-agent for its capabilities and updates
 // the tracer's behaviour.
 func (c *config) loadAgentFeatures() {
@@ -402,16 +553,22 @@ func (c *config) loadAgentFeatures() {
 		// there is no agent; all features off
 		return
 	}
-	resp, err := c.httpClient.Get(fmt.Sprintf("http://%s/info", c.agentAddr))
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/info", c.agentAddr), nil)
+	if err != nil {
+		log.Error("Loading features: %v", err)
+		return
+	}
+	c.setHTTPHeaders(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		log.Error("Loading features: %v", err)
 		return
 	}
+	defer closeBody(resp.Body)
 	if resp.StatusCode == http.StatusNotFound {
 		// agent is older than 7.28.0, features not discoverable
 		return
 	}
-	defer resp.Body.Close()
 	type infoResponse struct {
 		Endpoints     []string `json:"endpoints"`
 		ClientDropP0s bool     `json:"client_drop_p0s"`
@@ -425,12 +582,18 @@ func (c *config) loadAgentFeatures() {
 	}
 	c.agent.DropP0s = info.ClientDropP0s
 	c.agent.StatsdPort = info.StatsdPort
+	var v03, v04 bool
 	for _, endpoint := range info.Endpoints {
 		switch endpoint {
 		case "/v0.6/stats":
 			c.agent.Stats = true
+		case "/v0.4/traces":
+			v04 = true
+		case "/v0.3/traces":
+			v03 = true
 		}
 	}
+	c.agent.legacyTraces = v03 && !v04
 	c.agent.featureFlags = make(map[string]struct{}, len(info.FeatureFlags))
 	for _, flag := range info.FeatureFlags {
 		c.agent.featureFlags[flag] = struct{}{}
@@ -531,6 +694,17 @@ func WithLambdaMode(enabled bool) StartOption {
 	}
 }
 
+// WithTraceOutput causes traces to be written to w as JSON instead of being sent to
+// the agent, one payload per line. This is useful during local development to inspect
+// what would be sent without running an agent. Writes to w are serialized. Traces can
+// also be written to the standard output by setting DD_TRACE_TO_STDOUT=true.
+func WithTraceOutput(w io.Writer) StartOption {
+	return func(c *config) {
+		c.logToStdout = true
+		c.traceOutput = w
+	}
+}
+
 // WithPropagator sets an alternative propagator to be used by the tracer.
 func WithPropagator(p Propagator) StartOption {
 	return func(c *config) {
@@ -599,6 +773,67 @@ func WithGlobalTag(k string, v interface{}) StartOption {
 	}
 }
 
+// WithHTTPHeaders sets headers which are added to every request sent to the agent,
+// such as the credentials required by a proxy standing between the tracer and the
+// agent. This option may be used multiple times. Requests rejected as unauthorized
+// are reported as such and are not retried.
+func WithHTTPHeaders(headers map[string]string) StartOption {
+	return func(c *config) {
+		if c.httpHeaders == nil {
+			c.httpHeaders = make(map[string]string, len(headers))
+		}
+		for k, v := range headers {
+			c.httpHeaders[k] = v
+		}
+	}
+}
+
+// WithHTTPHeadersFunc registers fn to return headers which are added to every request
+// sent to the agent, after those set using WithHTTPHeaders. It is called for every
+// request, so it can provide credentials which change over time, such as rotating
+// tokens. fn must be safe for concurrent use.
+func WithHTTPHeadersFunc(fn func() map[string]string) StartOption {
+	return func(c *config) {
+		c.httpHeadersFunc = fn
+	}
+}
+
+// WithClockSync enables correcting the start time of spans by the offset between the
+// local clock and the agent's clock, as observed from the Date header of the agent's
+// responses, for hosts whose clock can not be kept synchronized. The correction is
+// applied to traces as they are sent, to every span of a trace alike, so durations
+// and the relative timing of spans are preserved. Only offsets of at least two
+// seconds are corrected. It is disabled by default.
+func WithClockSync(enabled bool) StartOption {
+	return func(c *config) {
+		c.clockSync = enabled
+	}
+}
+
+// WithFlushTags registers fn to return tags which are set on every trace when it is
+// about to be sent, rather than when its spans are created. Unlike tags set using
+// WithGlobalTag, they reflect values which may change while spans are in progress,
+// such as the version serving traffic during a blue/green deployment. The tags are
+// set on the first span of each trace chunk, where trace-level tags are also set,
+// and take precedence over any tag of the same key set on that span. fn is called
+// from a single goroutine for every trace and should be cheap.
+func WithFlushTags(fn func() map[string]string) StartOption {
+	return func(c *config) {
+		c.flushTags = fn
+	}
+}
+
+// WithTraceSummary enables setting metrics summarizing each trace on its local root
+// span when the trace is about to be sent: _dd.span_count, the number of spans sent
+// for the trace, and _dd.trace_error, set to 1 when any of them has an error. They
+// are computed after spans are filtered and sampled, and are not set when the local
+// root itself is not sent, such as when it was dropped by a span filter.
+func WithTraceSummary(enabled bool) StartOption {
+	return func(c *config) {
+		c.traceSummary = enabled
+	}
+}
+
 // WithSampler sets the given sampler to be used with the tracer. By default
 // an all-permissive sampler is used.
 func WithSampler(s Sampler) StartOption {
@@ -623,6 +858,103 @@ func WithHTTPClient(client *http.Client) StartOption {
 	}
 }
 
+// WithConnectionPool tunes the pool of connections kept open to the agent. At most
+// maxIdle idle connections are kept alive, each for up to idleTimeout. Zero values
+// keep the defaults, which are 100 connections and 90 seconds. It applies to the
+// default HTTP client as well as to one given using WithHTTPClient or WithUDS,
+// which is copied rather than modified.
+func WithConnectionPool(maxIdle int, idleTimeout time.Duration) StartOption {
+	return func(c *config) {
+		c.maxIdleConns = maxIdle
+		c.idleConnTimeout = idleTimeout
+	}
+}
+
+// WithSpanPooling specifies whether spans are recycled once they were sent to the
+// agent, to be reused by spans started afterwards. This reduces allocations and
+// garbage collection pressure in programs starting many spans. It is disabled
+// by default.
+//
+// WARNING: once a trace is sent, its spans may be reset and reused at any time,
+// by any goroutine. Enabling this is only safe when no span is used after the
+// trace it belongs to has finished: not to set tags, nor to start a child span
+// using its context, nor to read its fields. Violating it corrupts unrelated traces.
+// In particular, the following common patterns are unsafe with pooling:
+//   - calling Finish more than once, as in an explicit call followed by a deferred
+//     one: the later call may finish whichever span now reuses the memory;
+//   - starting spans using ChildOf with the context of a finished span, as from a
+//     background goroutine outliving its parent (see the package documentation):
+//     the parent's trace may have been sent and its spans reused meanwhile. Contexts
+//     stop referring to their span once it is recycled, so such children are no
+//     longer given the tags of an unrelated span, but they may still join a trace
+//     whose root was reused.
+func WithSpanPooling(enabled bool) StartOption {
+	return func(c *config) {
+		c.spanPooling = enabled
+	}
+}
+
+// WithContextTags registers fn to extract tags from the context given to
+// StartSpanFromContext, such as a tenant or user ID stored as a request-scoped value.
+// The tags it returns are set on every span started from a context, before the tags
+// given using the Tag option, which take precedence. fn is called each time a span
+// is started and must be fast and safe for concurrent use.
+func WithContextTags(fn func(ctx context.Context) map[string]string) StartOption {
+	return func(c *config) {
+		c.contextTags = fn
+	}
+}
+
+// WithInheritedTags specifies the keys of tags which are copied from a span to the
+// children started from it in the same process, for example to carry a request
+// identifier down a deep span tree without passing it through a context. Tags set on
+// a parent after its child was started are not copied. Tags set on the child itself
+// take precedence. By default, no tags are inherited.
+func WithInheritedTags(keys ...string) StartOption {
+	return func(c *config) {
+		c.inheritedTags = append(c.inheritedTags, keys...)
+	}
+}
+
+// WithSpanFilter registers fn to decide which spans are dropped instead of being sent
+// to the agent. It is called once for every finished span, after its trace has
+// finished, and reports whether the span should be dropped. Dropping a span also
+// drops its descendants, so dropping the root of a trace drops the entire trace and
+// no orphaned spans are sent. This can be used for example to ignore a noisy
+// endpoint sharing its service with important ones. fn is called from a single
+// goroutine and must not retain or modify the spans. A nil fn, the default, keeps
+// all spans. Panics in fn are recovered and logged, and keep the whole trace.
+func WithSpanFilter(fn func(s Span) (drop bool)) StartOption {
+	return func(c *config) {
+		c.spanFilter = fn
+	}
+}
+
+// WithSpanProcessor registers p to be notified of every span as it starts and finishes,
+// as described by SpanProcessor. It can be used several times to build a pipeline of
+// processors, which are called in the order they were registered. Panics in processors
+// are recovered and logged. Spans dropped by a processor are counted along with those
+// dropped by the span filter (see WithSpanFilter).
+func WithSpanProcessor(p SpanProcessor) StartOption {
+	return func(c *config) {
+		if p != nil {
+			c.spanProcessors = append(c.spanProcessors, p)
+		}
+	}
+}
+
+// WithFlushCallback registers fn to be called with the result of every attempt to
+// send a payload of traces to the agent, including payloads dropped without being
+// sent because the agent is unreachable. It allows reporting the tracer's activity
+// through a custom metrics pipeline. fn is called from the goroutine sending the
+// payload, possibly concurrently; it should return quickly. Panics in fn are
+// recovered and logged.
+func WithFlushCallback(fn func(FlushResult)) StartOption {
+	return func(c *config) {
+		c.flushCallback = fn
+	}
+}
+
 // WithUDS configures the HTTP client to dial the Datadog Agent via the specified Unix Domain Socket path.
 func WithUDS(socketPath string) StartOption {
 	return WithHTTPClient(udsClient(socketPath))
@@ -706,12 +1038,198 @@ func WithUniversalVersion(version string) StartOption {
 }
 
 // WithHostname allows specifying the hostname with which to mark outgoing traces.
+// It takes precedence over the hostname reported as a result of setting
+// DD_TRACE_REPORT_HOSTNAME; an empty name disables reporting the hostname.
 func WithHostname(name string) StartOption {
 	return func(c *config) {
 		c.hostname = name
 	}
 }
 
+// WithFlushHighWatermark causes the tracer to flush as soon as n spans are buffered,
+// instead of waiting for the next flush interval. It is useful for bursty workloads
+// which would otherwise accumulate a large number of spans in between flushes.
+// A value of zero (the default) disables it.
+func WithFlushHighWatermark(n int) StartOption {
+	return func(c *config) {
+		if n < 0 {
+			n = 0
+		}
+		c.flushHighWatermark = n
+	}
+}
+
+// OverflowPolicy specifies which traces the tracer drops when finished traces are
+// produced faster than they can be added to the payload.
+type OverflowPolicy int
+
+const (
+	// DropNewest drops the traces which can not be queued. This is the default.
+	DropNewest OverflowPolicy = iota
+
+	// DropOldest evicts the oldest queued trace to make room for the newest one,
+	// favoring recent data.
+	DropOldest
+)
+
+// WithMaxBufferedSpans sets a limit on the number of finished spans the tracer holds
+// in memory until they are sent to the agent, counting the spans which are queued,
+// buffered in a payload and being sent. When the agent is slow and traffic spikes,
+// traces which would exceed the limit are dropped as they finish, instead of growing
+// memory usage without bound. Traces dropped this way are never queued, so the
+// overflow policy (see WithOverflowPolicy) does not apply to them. Zero, the default,
+// means no limit.
+func WithMaxBufferedSpans(n int) StartOption {
+	return func(c *config) {
+		c.maxBufferedSpans = n
+	}
+}
+
+// WithQueueSize sets the capacity of the queue holding finished traces until the
+// tracer's worker adds them to the payload being sent. Finishing a span never waits
+// on the worker: traces which do not fit in a full queue are dropped according to
+// the overflow policy (see WithOverflowPolicy) and counted by the traces_dropped
+// health metric. A larger queue absorbs bigger bursts of finished traces, at the
+// cost of memory. Values lower than 1 leave the default of 1000.
+func WithQueueSize(n int) StartOption {
+	return func(c *config) {
+		c.queueSize = n
+	}
+}
+
+// WithResourceObfuscator sets a function which is applied to the resource of every
+// span as it finishes, to scrub PII or high-cardinality values out of it so that the
+// same logical operation always groups together. The resource is obfuscated before
+// stats are computed, so stats and traces agree. ObfuscateSQL and ObfuscateURL are
+// provided as built-in obfuscators, which may be combined based on the resource:
+//
+//	tracer.Start(tracer.WithResourceObfuscator(func(resource string) string {
+//		if strings.HasPrefix(resource, "/") {
+//			return tracer.ObfuscateURL(resource)
+//		}
+//		return resource
+//	}))
+//
+// The function is called concurrently and must be safe for that.
+func WithResourceObfuscator(fn func(resource string) string) StartOption {
+	return func(c *config) {
+		c.resourceObfuscator = fn
+	}
+}
+
+// WithSamplingRatesPollInterval makes the tracer poll the agent for its sampling
+// rates at the given interval while no traces are being sent. The rates are
+// normally refreshed by the agent's response to every payload of traces, so they
+// can become stale while a service is idle; polling ensures it uses fresh rates
+// as soon as traffic resumes. Polls are skipped whenever a payload was sent within
+// the interval, so they add no requests to busy services. Polling is disabled by
+// default.
+func WithSamplingRatesPollInterval(d time.Duration) StartOption {
+	return func(c *config) {
+		c.ratesPollInterval = d
+	}
+}
+
+// WithoutWorker starts the tracer without its background worker, the goroutine
+// which periodically sends finished traces to the agent. This is useful when
+// flushing is driven by the caller's own scheduler, or when tracers are started
+// frequently. Finished traces are then only sent when Flush is called, and once
+// more when the tracer is stopped; nothing is flushed automatically. Traces are
+// dropped when the queue of finished traces fills up between two calls to Flush,
+// so it should be called often enough.
+func WithoutWorker() StartOption {
+	return func(c *config) {
+		c.noWorker = true
+	}
+}
+
+// WithCaptureCaller enables recording the file and line of the code which started
+// each span as its _dd.caller tag, to help find where a span comes from while
+// debugging. Frames within the tracer package are skipped, so the location is that
+// of the call to StartSpan, StartSpanFromContext or any other function starting
+// the span. It is off by default, as looking up the caller has a cost on every span.
+func WithCaptureCaller(enabled bool) StartOption {
+	return func(c *config) {
+		c.captureCaller = enabled
+	}
+}
+
+// WithOverflowPolicy sets the policy used to drop traces when the tracer's queue of
+// finished traces is full. Only complete traces are ever queued, so a policy always
+// drops whole traces. Regardless of the policy, a trace kept by the user or because
+// of errors, having a sampling priority of at least ext.PriorityUserKeep, evicts a
+// queued trace of lower priority rather than being dropped, so that such traces
+// survive an overflow. With DropNewest, other traces are dropped when the queue is
+// full; with DropOldest, they evict the oldest queued trace of lower or equal
+// priority. Only the oldest few queued traces are considered for eviction, and those
+// which are not evicted are requeued behind newer traces. The default is DropNewest.
+func WithOverflowPolicy(p OverflowPolicy) StartOption {
+	return func(c *config) {
+		c.overflowPolicy = p
+	}
+}
+
+// WithSpanRuntimeMetrics sets a snapshot of the Go runtime's state, namely the number
+// of goroutines and the number of bytes allocated on the heap, as metrics on the given
+// fraction of root spans when they finish. A rate of 1 applies it to all root spans.
+// It is disabled by default.
+//
+// WARNING: taking the snapshot stops the world in order to read memory statistics,
+// adding latency to the whole program. Use a low rate, and prefer WithRuntimeMetrics
+// for monitoring the runtime over time.
+func WithSpanRuntimeMetrics(rate float64) StartOption {
+	return func(c *config) {
+		if rate < 0 || rate > 1 || math.IsNaN(rate) {
+			log.Warn("ignoring WithSpanRuntimeMetrics rate %f: it must be between 0 and 1", rate)
+			return
+		}
+		c.spanRuntimeMetricsRate = rate
+	}
+}
+
+// WithMaxTagValueLength sets the maximum length in bytes of the values of tags
+// set on spans, including their name, service, resource and type. Longer values
+// are truncated and the span is tagged with "_dd.truncated". The default is 25000
+// and a value of zero disables the limit. Tag keys are limited to 200 bytes.
+func WithMaxTagValueLength(n int) StartOption {
+	return func(c *config) {
+		if n < 0 {
+			n = 0
+		}
+		c.maxTagValueLength = n
+	}
+}
+
+// WithMaxSpansPerTrace limits the number of spans recorded for a single trace to n.
+// Once a trace has reached the limit, any further spans started within it are
+// still returned but are discarded, and the trace is tagged with "_dd.spans_truncated".
+// This protects against runaway code creating an unbounded number of spans.
+// A value of zero (the default) sets no limit, other than the hard limit of
+// 100,000 spans after which a trace is dropped entirely.
+func WithMaxSpansPerTrace(n int) StartOption {
+	return func(c *config) {
+		if n < 0 {
+			n = 0
+		}
+		c.maxSpansPerTrace = n
+	}
+}
+
+// WithKeepErrors specifies whether traces containing a span finished with an error
+// are kept even when they were sampled out. When enabled, finishing a span with an
+// error sets the sampling priority of its trace to ext.PriorityUserKeep, unless the
+// trace already has a positive priority, and ensures the trace is sent to the agent.
+// No sampling decision maker is recorded for such traces, as neither the user nor a
+// sampler kept them. Traces rejected by the user, using ext.ManualDrop or a sampling
+// rule (see WithSamplingRules), keep their ext.PriorityUserReject priority. The
+// priority can not be changed after the root span has finished; traces whose errors
+// happen afterwards are still sent. It is enabled by default.
+func WithKeepErrors(enabled bool) StartOption {
+	return func(c *config) {
+		c.noKeepErrors = !enabled
+	}
+}
+
 // WithTraceEnabled allows specifying whether tracing will be enabled
 func WithTraceEnabled(enabled bool) StartOption {
 	return func(c *config) {
@@ -791,9 +1309,21 @@ func Measured() StartSpanOption {
 	return measuredTag
 }
 
+// Origin sets the origin of the trace started by the span, such as "synthetics"
+// or "lambda". The origin is propagated to all of the trace's spans, including
+// those in other services. It has no effect on spans which are not the root of
+// their trace, since those inherit the origin of their parent.
+func Origin(origin string) StartSpanOption {
+	return Tag(keyOrigin, origin)
+}
+
 // WithSpanID sets the SpanID on the started span, instead of using a random number.
 // If there is no parent Span (eg from ChildOf), then the TraceID will also be set to the
 // value given here.
+//
+// Samplers decide whether to keep a trace based on its trace ID only, without any
+// other source of randomness, so tests can use this option on root spans to get
+// reproducible sampling decisions for a given sample rate.
 func WithSpanID(id uint64) StartSpanOption {
 	return func(cfg *ddtrace.StartSpanConfig) {
 		cfg.SpanID = id
@@ -808,6 +1338,26 @@ func ChildOf(ctx ddtrace.SpanContext) StartSpanOption {
 	}
 }
 
+// WithParentIDs sets the trace ID and the parent span ID of the created span, as
+// if it was started using ChildOf with the context of a remote span. It is meant
+// for importing or replaying traces recorded by other systems; along with
+// WithSpanID and StartTime, it allows setting all of a span's IDs explicitly.
+// A parentID of zero starts the root span of the given trace. It overrides, and
+// is overridden by, ChildOf. A traceID of zero is ignored.
+func WithParentIDs(traceID, parentID uint64) StartSpanOption {
+	return func(cfg *ddtrace.StartSpanConfig) {
+		if traceID == 0 {
+			log.Warn("ignoring WithParentIDs: the trace ID can not be zero")
+			return
+		}
+		cfg.Parent = &spanContext{
+			traceID: traceID,
+			spanID:  parentID,
+			trace:   newTrace(),
+		}
+	}
+}
+
 // withContext associates the ctx with the span.
 func withContext(ctx context.Context) StartSpanOption {
 	return func(cfg *ddtrace.StartSpanConfig) {
@@ -19,6 +19,7 @@ import (
 	"time"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/globalconfig"
+	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/traceprof"
 
 	"github.com/stretchr/testify/assert"
@@ -190,6 +191,26 @@ func TestLoadAgentFeatures(t *testing.T) {
 		assert.True(t, cfg.agent.HasFlag("b"))
 	})
 
+	t.Run("legacy-traces", func(t *testing.T) {
+		for body, legacy := range map[string]bool{
+			`{"endpoints":["/v0.3/traces"]}`:                true,
+			`{"endpoints":["/v0.3/traces","/v0.4/traces"]}`: false,
+			`{"endpoints":[]}`:                              false,
+		} {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Write([]byte(body))
+			}))
+			cfg := newConfig(WithAgentAddr(strings.TrimPrefix(srv.URL, "http://")))
+			srv.Close()
+			assert.Equal(t, legacy, cfg.agent.legacyTraces, body)
+			if legacy {
+				assert.Equal(t, srv.URL+"/v0.3/traces", cfg.transport.endpoint())
+			} else {
+				assert.Equal(t, srv.URL+"/v0.4/traces", cfg.transport.endpoint())
+			}
+		}
+	})
+
 	t.Run("discovery", func(t *testing.T) {
 		defer func(old string) { os.Setenv("DD_TRACE_FEATURES", old) }(os.Getenv("DD_TRACE_FEATURES"))
 		os.Setenv("DD_TRACE_FEATURES", "discovery")
@@ -876,6 +897,18 @@ func TestWithTraceEnabled(t *testing.T) {
 		c := newConfig(WithTraceEnabled(true))
 		assert.True(c.enabled)
 	})
+
+	t.Run("env-invalid", func(t *testing.T) {
+		assert := assert.New(t)
+		tp := new(testLogger)
+		defer log.UseLogger(tp)()
+		os.Setenv("DD_TRACE_ENABLED", "maybe")
+		defer os.Unsetenv("DD_TRACE_ENABLED")
+		c := newConfig()
+		assert.True(c.enabled)
+		log.Flush()
+		assert.Contains(strings.Join(tp.Lines(), "\n"), "Non-boolean value for env var DD_TRACE_ENABLED, defaulting to true")
+	})
 }
 
 func TestWithLogStartup(t *testing.T) {
@@ -8,6 +8,7 @@ package tracer
 import (
 	"bytes"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -15,6 +16,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/tinylib/msgp/msgp"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 )
 
 var fixedTime = now()
@@ -74,6 +77,21 @@ func TestPayloadDecode(t *testing.T) {
 	}
 }
 
+// TestPayloadMetricsPrecision ensures that metrics are encoded without loss of precision.
+func TestPayloadMetricsPrecision(t *testing.T) {
+	assert := assert.New(t)
+	s := newBasicSpan("op")
+	s.SetTag(ext.DBRowCount, intUpperLimit-1)
+	s.SetTag(ext.HTTPResponseContentLength, uint32(math.MaxUint32))
+	s.SetTag("ratio", 0.1+0.2)
+	s.SetTag("small", math.SmallestNonzeroFloat64)
+	p := newPayload()
+	p.push(spanList{s})
+	var got spanLists
+	assert.NoError(msgp.Decode(p, &got))
+	assert.Equal(s.Metrics, got[0][0].Metrics)
+}
+
 func BenchmarkPayloadThroughput(b *testing.B) {
 	b.Run("10K", benchmarkPayloadThroughput(1))
 	b.Run("100K", benchmarkPayloadThroughput(10))
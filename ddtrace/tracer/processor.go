@@ -0,0 +1,62 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016 Datadog, Inc.
+
+package tracer
+
+import "gopkg.in/DataDog/dd-trace-go.v1/internal/log"
+
+// SpanProcessor is notified of every span as it starts and as it finishes. Processors
+// are registered using WithSpanProcessor and form a pipeline: each of them is called in
+// registration order, so that one processor may for example set tags which the next one
+// uses to decide whether to drop the span. Processors are called synchronously on the
+// goroutine starting or finishing the span, so they add to the latency of every span
+// and should be kept fast; any slow work, such as exporting spans, should be done
+// asynchronously.
+type SpanProcessor interface {
+	// OnStart is called once a span has started and its initial tags are set.
+	OnStart(s Span)
+
+	// OnEnd is called by the first call to Finish, right before the span is marked
+	// finished, so it may still set tags on it. It reports whether the span must be
+	// dropped instead of being sent, in which case its descendants are dropped too
+	// and the processors which follow are not called.
+	OnEnd(s Span) (drop bool)
+}
+
+// processStart calls the OnStart method of the span processors of s.
+func (s *span) processStart() {
+	for _, p := range s.processors {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Error("Span processor panicked on start of span %q: %v", s.Name, err)
+				}
+			}()
+			p.OnStart(s)
+		}()
+	}
+}
+
+// processEnd calls the OnEnd method of the span processors of s, which are those of
+// the tracer which started it, until one of them drops the span.
+func (s *span) processEnd() {
+	for _, p := range s.processors {
+		var drop bool
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Error("Span processor panicked on end of span %q: %v", s.Name, err)
+				}
+			}()
+			drop = p.OnEnd(s)
+		}()
+		if drop {
+			s.Lock()
+			s.dropped = true
+			s.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016 Datadog, Inc.
+
+package tracer
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
+)
+
+// funcProcessor is a SpanProcessor calling the given functions, when set.
+type funcProcessor struct {
+	onStart func(Span)
+	onEnd   func(Span) bool
+}
+
+func (p funcProcessor) OnStart(s Span) {
+	if p.onStart != nil {
+		p.onStart(s)
+	}
+}
+
+func (p funcProcessor) OnEnd(s Span) bool {
+	if p.onEnd != nil {
+		return p.onEnd(s)
+	}
+	return false
+}
+
+func TestSpanProcessor(t *testing.T) {
+	assert := assert.New(t)
+	tp := new(log.RecordLogger)
+	defer log.UseLogger(tp)()
+
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	record := func(event string) func(Span) {
+		return func(s Span) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, event+" "+s.(*span).Name)
+		}
+	}
+	trc, transport, flush, stop := startTestTracer(t,
+		WithSpanProcessor(funcProcessor{
+			onStart: func(Span) { panic("oops") },
+			onEnd:   func(s Span) bool { s.SetTag("processed", true); return false },
+		}),
+		WithSpanProcessor(funcProcessor{
+			onStart: record("start"),
+			onEnd: func(s Span) bool {
+				record("end")(s)
+				return s.(*span).Meta["processed"] == "true" && s.(*span).Name == "db.query"
+			},
+		}),
+		WithSpanProcessor(funcProcessor{onEnd: func(s Span) bool { record("export")(s); return false }}),
+		WithSpanProcessor(nil),
+	)
+	defer stop()
+
+	root := trc.StartSpan("web.request")
+	query := trc.StartSpan("db.query", ChildOf(root.Context()))
+	trc.StartSpan("db.rows", ChildOf(query.Context())).Finish()
+	query.Finish()
+	root.Finish()
+	flush(1)
+
+	assert.Equal([]string{
+		"start web.request",
+		"start db.query",
+		"start db.rows",
+		"end db.rows",
+		"export db.rows",
+		"end db.query",
+		// the span was dropped, so the exporter is not called
+		"end web.request",
+		"export web.request",
+	}, calls)
+	traces := transport.Traces()
+	// the dropped span's descendants are dropped too
+	assert.Len(traces[0], 1)
+	assert.Equal("web.request", traces[0][0].Name)
+	assert.Equal("true", traces[0][0].Meta["processed"])
+	log.Flush()
+	var found bool
+	for _, l := range tp.Logs() {
+		found = found || strings.Contains(l, `Span processor panicked on start of span "web.request": oops`)
+	}
+	assert.True(found, "panic not logged: %q", tp.Logs())
+}
+
+func TestSpanProcessorOwnTracer(t *testing.T) {
+	assert := assert.New(t)
+	var globalEnds, ownEnds int32
+	count := func(n *int32) funcProcessor {
+		return funcProcessor{onEnd: func(Span) bool { atomic.AddInt32(n, 1); return false }}
+	}
+	_, _, _, stop := startTestTracer(t, WithSpanProcessor(count(&globalEnds)))
+	defer stop()
+
+	// a span ends with the processors of the tracer which started it, rather
+	// than those of the global tracer
+	own := newUnstartedTracer(WithSpanProcessor(count(&ownEnds)))
+	own.StartSpan("op").Finish()
+	assert.EqualValues(1, atomic.LoadInt32(&ownEnds))
+	assert.EqualValues(0, atomic.LoadInt32(&globalEnds))
+
+	// even when the global tracer is replaced while the span is in progress
+	sp := StartSpan("op")
+	_, _, _, stop2 := startTestTracer(t)
+	defer stop2()
+	sp.Finish()
+	assert.EqualValues(1, atomic.LoadInt32(&globalEnds))
+}
@@ -0,0 +1,66 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016 Datadog, Inc.
+
+package tracer
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/DataDog/datadog-agent/pkg/obfuscate"
+)
+
+var (
+	sqlObfuscatorOnce sync.Once
+	sqlObfuscator     *obfuscate.Obfuscator
+)
+
+// ObfuscateSQL is a resource obfuscator, to be used with WithResourceObfuscator,
+// which normalizes SQL queries by replacing literals with "?", so that queries
+// differing only by their arguments group together. Queries which can not be
+// parsed are replaced with "Non-parsable SQL query".
+func ObfuscateSQL(query string) string {
+	if query == "" {
+		return ""
+	}
+	sqlObfuscatorOnce.Do(func() {
+		sqlObfuscator = obfuscate.NewObfuscator(obfuscate.Config{})
+	})
+	oq, err := sqlObfuscator.ObfuscateSQLString(query)
+	if err != nil {
+		return textNonParsable
+	}
+	return oq.Query
+}
+
+// ObfuscateURL is a resource obfuscator, to be used with WithResourceObfuscator,
+// which normalizes URLs and URL paths by stripping the query string and fragment
+// and replacing numeric path segments, such as ids, with "?". For example,
+// "GET /users/42/orders?page=2" becomes "GET /users/?/orders".
+func ObfuscateURL(url string) string {
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		url = url[:i]
+	}
+	segments := strings.Split(url, "/")
+	for i, seg := range segments {
+		if isNumeric(seg) {
+			segments[i] = "?"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// isNumeric reports whether s is a non-empty string made only of ASCII digits.
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,40 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016 Datadog, Inc.
+
+package tracer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObfuscateSQL(t *testing.T) {
+	for in, out := range map[string]string{
+		"SELECT * FROM users WHERE id = 42":                  "SELECT * FROM users WHERE id = ?",
+		"SELECT * FROM users WHERE name = 'Zoë' AND age > 3": "SELECT * FROM users WHERE name = ? AND age > ?",
+		"INSERT INTO t (a, b) VALUES ('日本語', 1.5)":           "INSERT INTO t ( a, b ) VALUES ( ? )",
+		"SELECT * FROM users WHERE name = 'unterminated":     textNonParsable,
+		"": "",
+	} {
+		assert.Equal(t, out, ObfuscateSQL(in), in)
+	}
+}
+
+func TestObfuscateURL(t *testing.T) {
+	for in, out := range map[string]string{
+		"/users/42":                             "/users/?",
+		"GET /users/42/orders?page=2":           "GET /users/?/orders",
+		"http://localhost:8080/items/7#details": "http://localhost:8080/items/?",
+		"/café/12/ünïcode/v2":                   "/café/?/ünïcode/v2",
+		"/users/42abc":                          "/users/42abc",
+		"/%zz/12?":                              "/%zz/?",
+		"?":                                     "",
+		"":                                      "",
+		"/\xff\xfe/1":                           "/\xff\xfe/?",
+	} {
+		assert.Equal(t, out, ObfuscateURL(in), in)
+	}
+}
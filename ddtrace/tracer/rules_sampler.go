@@ -53,7 +53,7 @@ func (r *rulesSampler) HasSpanRules() bool { return r.spans.enabled() }
 func (r *rulesSampler) TraceRateLimit() (float64, bool) { return r.traces.limit() }
 
 // SamplingRule is used for applying sampling rates to spans that match
-// the service name, operation name or both.
+// the service name, operation name, resource name or any combination of them.
 // For basic usage, consider using the helper functions ServiceRule, NameRule, etc.
 type SamplingRule struct {
 	// Service specifies the regex pattern that a span service name must match.
@@ -62,8 +62,11 @@ type SamplingRule struct {
 	// Name specifies the regex pattern that a span operation name must match.
 	Name *regexp.Regexp
 
+	// Resource specifies the regex pattern that a span resource name must match.
+	Resource *regexp.Regexp
+
 	// Rate specifies the sampling rate that should be applied to spans that match
-	// service and/or name of the rule.
+	// service, name and/or resource of the rule.
 	Rate float64
 
 	// MaxPerSecond specifies max number of spans per second that can be sampled per the rule.
@@ -88,6 +91,9 @@ func (sr *SamplingRule) match(s *span) bool {
 	} else if sr.exactName != "" && sr.exactName != s.Name {
 		return false
 	}
+	if sr.Resource != nil && !sr.Resource.MatchString(s.Resource) {
+		return false
+	}
 	return true
 }
 
@@ -147,6 +153,25 @@ func NameServiceRule(name string, service string, rate float64) SamplingRule {
 	}
 }
 
+// ResourceRule returns a SamplingRule that applies the provided sampling rate
+// to spans whose resource name matches the glob pattern provided. In a pattern,
+// '*' matches any sequence of characters and '?' matches a single character,
+// so a prefix match is written as "GET /api/*".
+//
+// Rules are checked in the order they are given to WithSamplingRules and the
+// first match wins, so rules for narrower patterns should come before rules
+// for the broader patterns overlapping them. Traces matching no rule use the
+// rate set by DD_TRACE_SAMPLE_RATE, or a trailing RateRule.
+//
+// Sampling decisions are taken when the root span starts, so the resource must
+// be set using the ResourceName start option for the rule to apply.
+func ResourceRule(resource string, rate float64) SamplingRule {
+	return SamplingRule{
+		Resource: globMatch(resource),
+		Rate:     rate,
+	}
+}
+
 // RateRule returns a SamplingRule that applies the provided sampling rate to all spans.
 func RateRule(rate float64) SamplingRule {
 	return SamplingRule{
@@ -499,6 +524,7 @@ func unmarshalSamplingRules(b []byte, spanType SamplingRuleType) ([]SamplingRule
 	var jsonRules []struct {
 		Service      string      `json:"service"`
 		Name         string      `json:"name"`
+		Resource     string      `json:"resource"`
 		Rate         json.Number `json:"sample_rate"`
 		MaxPerSecond float64     `json:"max_per_second"`
 	}
@@ -537,14 +563,23 @@ func unmarshalSamplingRules(b []byte, spanType SamplingRuleType) ([]SamplingRule
 				ruleType:     SamplingRuleSpan,
 			})
 		case SamplingRuleTrace:
+			var rule SamplingRule
 			switch {
 			case v.Service != "" && v.Name != "":
-				rules = append(rules, NameServiceRule(v.Name, v.Service, rate))
+				rule = NameServiceRule(v.Name, v.Service, rate)
 			case v.Service != "":
-				rules = append(rules, ServiceRule(v.Service, rate))
+				rule = ServiceRule(v.Service, rate)
 			case v.Name != "":
-				rules = append(rules, NameRule(v.Name, rate))
+				rule = NameRule(v.Name, rate)
+			case v.Resource != "":
+				rule = RateRule(rate)
+			default:
+				continue
+			}
+			if v.Resource != "" {
+				rule.Resource = globMatch(v.Resource)
 			}
+			rules = append(rules, rule)
 		}
 	}
 	if len(errs) != 0 {
@@ -558,6 +593,7 @@ func (sr *SamplingRule) MarshalJSON() ([]byte, error) {
 	s := struct {
 		Service      string   `json:"service"`
 		Name         string   `json:"name"`
+		Resource     string   `json:"resource,omitempty"`
 		Rate         float64  `json:"sample_rate"`
 		Type         string   `json:"type"`
 		MaxPerSecond *float64 `json:"max_per_second,omitempty"`
@@ -572,6 +608,9 @@ func (sr *SamplingRule) MarshalJSON() ([]byte, error) {
 	} else if sr.Name != nil {
 		s.Name = fmt.Sprintf("%s", sr.Name)
 	}
+	if sr.Resource != nil {
+		s.Resource = fmt.Sprintf("%s", sr.Resource)
+	}
 	s.Rate = sr.Rate
 	s.Type = fmt.Sprintf("%v(%d)", sr.ruleType.String(), sr.ruleType)
 	if sr.MaxPerSecond != 0 {
@@ -10,6 +10,7 @@ import (
 	"io"
 	"math"
 	"sync"
+	"time"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
@@ -22,6 +23,15 @@ type Sampler interface {
 	Sample(span Span) bool
 }
 
+// SamplerFunc is an adapter which allows the use of an ordinary function as a Sampler.
+// It is consulted for every new trace once the root span has been created, and its
+// decision applies to all the spans in the trace. SamplerFunc runs on the hot path: it
+// must be fast, non-blocking and safe for concurrent use.
+type SamplerFunc func(span Span) bool
+
+// Sample implements Sampler.
+func (f SamplerFunc) Sample(span Span) bool { return f(span) }
+
 // RateSampler is a sampler implementation which randomly selects spans using a
 // provided rate. For example, a rate of 0.75 will permit 75% of the spans.
 // RateSampler implementations should be safe for concurrent use.
@@ -68,7 +78,8 @@ const knuthFactor = uint64(1111111111111111111)
 
 // Sample returns true if the given span should be sampled.
 func (r *rateSampler) Sample(spn ddtrace.Span) bool {
-	if r.rate == 1 {
+	rate := r.Rate()
+	if rate == 1 {
 		// fast path
 		return true
 	}
@@ -76,9 +87,7 @@ func (r *rateSampler) Sample(spn ddtrace.Span) bool {
 	if !ok {
 		return false
 	}
-	r.RLock()
-	defer r.RUnlock()
-	return sampledByRate(s.TraceID, r.rate)
+	return sampledByRate(s.TraceID, rate)
 }
 
 // sampledByRate verifies if the number n should be sampled at the specified
@@ -90,6 +99,112 @@ func sampledByRate(n uint64, rate float64) bool {
 	return true
 }
 
+// AdaptiveSampler is a sampler which continuously adjusts its sample rate so that
+// the number of traces it keeps stays close to a target number per second.
+// AdaptiveSampler implementations should be safe for concurrent use.
+type AdaptiveSampler interface {
+	Sampler
+
+	// Rate returns the sample rate currently in effect.
+	Rate() float64
+
+	// SetTargetTPS sets the number of traces per second the sampler aims to keep.
+	SetTargetTPS(tps float64)
+}
+
+const (
+	// adaptiveSamplerInterval specifies how often the adaptive sampler
+	// adjusts its rate.
+	adaptiveSamplerInterval = time.Second
+
+	// adaptiveSamplerDecay specifies the weight given to the previously observed
+	// traces per second for each interval elapsed since the last adjustment.
+	// Higher values make the sampler slower to react to changes in traffic.
+	adaptiveSamplerDecay = 0.5
+)
+
+// adaptiveSampler samples traces at a rate derived from a decaying average
+// of the number of traces seen per second.
+type adaptiveSampler struct {
+	now func() time.Time
+
+	mu       sync.Mutex // guards below fields
+	target   float64    // traces per second to keep
+	rate     float64    // sample rate in effect
+	seen     float64    // traces seen since the last adjustment
+	observed float64    // decaying average of traces seen per second; negative until measured
+	last     time.Time  // time of the last adjustment
+}
+
+// NewAdaptiveSampler returns an AdaptiveSampler which aims to keep tps traces
+// per second. It starts by keeping all traces and adjusts its rate every second
+// based on the observed traffic, so a sudden spike in traffic is only sampled
+// down after the first second. The decision taken for a root span applies to
+// the entire trace.
+func NewAdaptiveSampler(tps float64) AdaptiveSampler {
+	return &adaptiveSampler{
+		now:      time.Now,
+		target:   tps,
+		rate:     1,
+		observed: -1,
+		last:     time.Now(),
+	}
+}
+
+// Rate returns the sample rate currently in effect.
+func (a *adaptiveSampler) Rate() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rate
+}
+
+// SetTargetTPS sets the number of traces per second the sampler aims to keep.
+// It takes effect on the next adjustment.
+func (a *adaptiveSampler) SetTargetTPS(tps float64) {
+	a.mu.Lock()
+	a.target = tps
+	a.mu.Unlock()
+}
+
+// Sample returns true if the given span should be sampled.
+func (a *adaptiveSampler) Sample(spn ddtrace.Span) bool {
+	s, ok := spn.(*span)
+	if !ok {
+		return false
+	}
+	a.mu.Lock()
+	if now := a.now(); now.Sub(a.last) >= adaptiveSamplerInterval {
+		a.adjust(now.Sub(a.last))
+		a.last = now
+	}
+	a.seen++
+	rate := a.rate
+	a.mu.Unlock()
+	return sampledByRate(s.TraceID, rate)
+}
+
+// adjust updates the sample rate using the traces seen during the elapsed time.
+// It must be called with a.mu held.
+func (a *adaptiveSampler) adjust(elapsed time.Duration) {
+	tps := a.seen / elapsed.Seconds()
+	a.seen = 0
+	if a.observed < 0 {
+		a.observed = tps
+	} else {
+		// the longer since the last adjustment, the less history weighs
+		w := math.Pow(adaptiveSamplerDecay, elapsed.Seconds()/adaptiveSamplerInterval.Seconds())
+		a.observed = w*a.observed + (1-w)*tps
+	}
+	switch {
+	case a.target <= 0:
+		a.rate = 0
+	case a.observed <= a.target:
+		a.rate = 1
+	default:
+		a.rate = a.target / a.observed
+	}
+}
+
 // prioritySampler holds a set of per-service sampling rates and applies
 // them to spans.
 type prioritySampler struct {
@@ -110,10 +225,13 @@ func (ps *prioritySampler) readRatesJSON(rc io.ReadCloser) error {
 	var payload struct {
 		Rates map[string]float64 `json:"rate_by_service"`
 	}
-	if err := json.NewDecoder(rc).Decode(&payload); err != nil {
+	defer closeBody(rc)
+	if err := json.NewDecoder(rc).Decode(&payload); err == io.EOF {
+		// no rates were sent
+		return nil
+	} else if err != nil {
 		return err
 	}
-	rc.Close()
 	const defaultRateKey = "service:,env:"
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
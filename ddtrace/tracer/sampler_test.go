@@ -13,6 +13,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -177,6 +178,63 @@ func TestRateSampler(t *testing.T) {
 	assert.False(NewRateSampler(0.99).Sample(internal.NoopSpan{}))
 }
 
+func TestRateSamplerConsistent(t *testing.T) {
+	// spans sharing a trace ID always get the same decision
+	rs := NewRateSampler(0.5)
+	var kept int
+	for id := uint64(1); id <= 1000; id++ {
+		want := rs.Sample(newSpan("op", "svc", "", id, id, 0))
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, want, rs.Sample(newSpan("op", "svc", "", random.Uint64(), id, 0)))
+		}
+		if want {
+			kept++
+		}
+	}
+	assert.InDelta(t, 500, kept, 50)
+}
+
+func TestRateSamplerAgentCompatible(t *testing.T) {
+	// the decisions the agent makes for these trace IDs, hashing them using the
+	// same Knuth multiplicative hash, so that both keep and drop the same traces
+	for _, tt := range []struct {
+		traceID uint64
+		kept    [3]bool // at rates 0.1, 0.5 and 0.9
+	}{
+		{1, [3]bool{true, true, true}},
+		{2, [3]bool{false, true, true}},
+		{3, [3]bool{false, true, true}},
+		{1882305164521835798, [3]bool{false, true, true}},
+		{5198373796167680436, [3]bool{false, false, true}},
+		{9223372036854775807, [3]bool{false, true, true}},
+		{12078589664685934330, [3]bool{false, false, true}},
+		{13794769880582338323, [3]bool{false, true, true}},
+	} {
+		for i, rate := range []float64{0.1, 0.5, 0.9} {
+			s := newSpan("op", "svc", "", tt.traceID, tt.traceID, 0)
+			assert.Equal(t, tt.kept[i], NewRateSampler(rate).Sample(s), "trace %d at rate %v", tt.traceID, rate)
+		}
+	}
+}
+
+func TestSamplerFunc(t *testing.T) {
+	assert := assert.New(t)
+	var calls int32
+	tracer := newTracer(WithSampler(SamplerFunc(func(s Span) bool {
+		atomic.AddInt32(&calls, 1)
+		return s.Context().TraceID() != 1
+	})), withTransport(newDummyTransport()))
+	defer tracer.Stop()
+
+	root := tracer.StartSpan("op").(*span)
+	assert.Equal(decisionNone, root.context.trace.samplingDecision)
+	root = tracer.StartSpan("op", WithSpanID(1)).(*span)
+	assert.Equal(decisionDrop, root.context.trace.samplingDecision)
+	child := tracer.StartSpan("child", ChildOf(root.Context())).(*span)
+	assert.Equal(root.context.trace, child.context.trace)
+	assert.EqualValues(2, atomic.LoadInt32(&calls))
+}
+
 func TestRateSamplerSetting(t *testing.T) {
 	assert := assert.New(t)
 	rs := NewRateSampler(1)
@@ -185,6 +243,88 @@ func TestRateSamplerSetting(t *testing.T) {
 	assert.Equal(0.5, rs.Rate())
 }
 
+func TestRateSamplerConcurrentSetRate(t *testing.T) {
+	rs := NewRateSampler(1)
+	tracer := newTracer(WithSampler(rs), withTransport(newDummyTransport()))
+	defer tracer.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				rs.SetRate(float64((i+j)%2) / 2)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				tracer.StartSpan("op").Finish()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestAdaptiveSampler(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	as := NewAdaptiveSampler(10).(*adaptiveSampler)
+	as.now = func() time.Time { return now }
+	as.last = now
+	sample := func(n int) (kept int) {
+		for i := 0; i < n; i++ {
+			if as.Sample(newBasicSpan("test")) {
+				kept++
+			}
+		}
+		return kept
+	}
+
+	// all traces are kept until the first adjustment
+	assert.Equal(1000, sample(1000))
+	assert.Equal(1.0, as.Rate())
+
+	// 1000 traces per second were seen
+	now = now.Add(time.Second)
+	sample(1)
+	assert.Equal(0.01, as.Rate())
+
+	// a spike only partially raises the observed rate
+	sample(2999)
+	now = now.Add(time.Second)
+	sample(1)
+	assert.Equal(10/2000.0, as.Rate())
+
+	// traffic stops and the observed rate decays
+	now = now.Add(time.Second)
+	sample(1)
+	assert.InDelta(10/1000.0, as.Rate(), 0.0001)
+	now = now.Add(10 * time.Second)
+	sample(1)
+	assert.Equal(1.0, as.Rate())
+
+	as.SetTargetTPS(0)
+	now = now.Add(time.Second)
+	assert.False(as.Sample(newBasicSpan("test")))
+	assert.Equal(0.0, as.Rate())
+	assert.False(as.Sample(internal.NoopSpan{}))
+}
+
+func TestAdaptiveSamplerTrace(t *testing.T) {
+	assert := assert.New(t)
+	as := NewAdaptiveSampler(0).(*adaptiveSampler)
+	as.rate = 0
+	tracer := newTracer(WithSampler(as), withTransport(newDummyTransport()))
+	defer tracer.Stop()
+
+	root := tracer.StartSpan("op").(*span)
+	child := tracer.StartSpan("child", ChildOf(root.Context())).(*span)
+	assert.Equal(decisionDrop, root.context.trace.samplingDecision)
+	assert.Equal(root.context.trace, child.context.trace)
+}
+
 func TestRuleEnvVars(t *testing.T) {
 	t.Run("sample-rate", func(t *testing.T) {
 		assert := assert.New(t)
@@ -253,7 +393,7 @@ func TestRuleEnvVars(t *testing.T) {
 				// invalid rule ignored
 				value:  `[{"service": "abcd", "sample_rate": 42.0}, {"service": "abcd", "sample_rate": 0.2}]`,
 				ruleN:  1,
-				errStr: "\n\tat index 0: ignoring rule {Service:abcd Name: Rate:42.0 MaxPerSecond:0}: rate is out of [0.0, 1.0] range",
+				errStr: "\n\tat index 0: ignoring rule {Service:abcd Name: Resource: Rate:42.0 MaxPerSecond:0}: rate is out of [0.0, 1.0] range",
 			}, {
 				value:  `not JSON at all`,
 				errStr: "\n\terror unmarshalling JSON: invalid character 'o' in literal null (expecting 'u')",
@@ -294,13 +434,13 @@ func TestRuleEnvVars(t *testing.T) {
 				// invalid rule ignored
 				value:  `[{"service": "abcd", "sample_rate": 42.0}, {"service": "abcd", "sample_rate": 0.2}]`,
 				ruleN:  1,
-				errStr: "\n\tat index 0: ignoring rule {Service:abcd Name: Rate:42.0 MaxPerSecond:0}: rate is out of [0.0, 1.0] range",
+				errStr: "\n\tat index 0: ignoring rule {Service:abcd Name: Resource: Rate:42.0 MaxPerSecond:0}: rate is out of [0.0, 1.0] range",
 			}, {
 				value:  `not JSON at all`,
 				errStr: "\n\terror unmarshalling JSON: invalid character 'o' in literal null (expecting 'u')",
 			}, {
 				value:  `[{"sample_rate": 1.0}]`,
-				errStr: "\n\tat index 0: ignoring rule {Service: Name: Rate:1.0 MaxPerSecond:0}: service name and operation name are not provided",
+				errStr: "\n\tat index 0: ignoring rule {Service: Name: Resource: Rate:1.0 MaxPerSecond:0}: service name and operation name are not provided",
 			},
 		} {
 			t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
@@ -561,6 +701,73 @@ func TestRulesSampler(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("resource", func(t *testing.T) {
+		rules := []SamplingRule{
+			ResourceRule("GET /api/users/*", 1.0),
+			ResourceRule("GET /api/*", 0.0),
+			ResourceRule("GET /health?", 0.5),
+			RateRule(0.2),
+		}
+		for _, tt := range []struct {
+			resource string
+			rate     float64
+		}{
+			// the narrower pattern comes first, so it wins over the broader one
+			{resource: "GET /api/users/42", rate: 1.0},
+			{resource: "GET /api/orders", rate: 0.0},
+			{resource: "GET /healthz", rate: 0.5},
+			{resource: "GET /health", rate: 0.2},
+			{resource: "POST /api/users/42", rate: 0.2},
+			{resource: "", rate: 0.2},
+		} {
+			t.Run(tt.resource, func(t *testing.T) {
+				assert := assert.New(t)
+				rs := newRulesSampler(rules, nil)
+
+				span := newSpan("http.request", "test-service", tt.resource, 0, 0, 0)
+				assert.True(rs.SampleTrace(span))
+				assert.Equal(tt.rate, span.Metrics[keyRulesSamplerAppliedRate])
+			})
+		}
+	})
+
+	t.Run("resource-precedence", func(t *testing.T) {
+		assert := assert.New(t)
+		// the broader pattern comes first and shadows the narrower one
+		rs := newRulesSampler([]SamplingRule{
+			ResourceRule("GET /api/*", 0.0),
+			ResourceRule("GET /api/users/*", 1.0),
+		}, nil)
+
+		span := newSpan("http.request", "test-service", "GET /api/users/42", 0, 0, 0)
+		assert.True(rs.SampleTrace(span))
+		assert.Equal(0.0, span.Metrics[keyRulesSamplerAppliedRate])
+		p, ok := span.context.samplingPriority()
+		assert.True(ok)
+		assert.Equal(ext.PriorityUserReject, p)
+	})
+
+	t.Run("resource-from-env", func(t *testing.T) {
+		assert := assert.New(t)
+		os.Setenv("DD_TRACE_SAMPLING_RULES", `[{"resource": "GET /api/*", "sample_rate": 0.0}, {"service": "test-service", "resource": "GET /*", "sample_rate": 1.0}]`)
+		defer os.Unsetenv("DD_TRACE_SAMPLING_RULES")
+		rules, _, err := samplingRulesFromEnv()
+		assert.NoError(err)
+		assert.Len(rules, 2)
+		rs := newRulesSampler(rules, nil)
+
+		span := newSpan("http.request", "test-service", "GET /api/users", 0, 0, 0)
+		assert.True(rs.SampleTrace(span))
+		assert.Equal(0.0, span.Metrics[keyRulesSamplerAppliedRate])
+
+		span = newSpan("http.request", "test-service", "GET /", 0, 0, 0)
+		assert.True(rs.SampleTrace(span))
+		assert.Equal(1.0, span.Metrics[keyRulesSamplerAppliedRate])
+
+		span = newSpan("http.request", "other-service", "GET /", 0, 0, 0)
+		assert.False(rs.SampleTrace(span))
+	})
 }
 
 func TestRulesSamplerConcurrency(t *testing.T) {
@@ -860,18 +1067,20 @@ func TestSamplingRuleMarshall(t *testing.T) {
 		in  SamplingRule
 		out string
 	}{
-		{SamplingRule{nil, nil, 0, 0, 0, "srv", "ops", nil},
+		{SamplingRule{nil, nil, nil, 0, 0, 0, "srv", "ops", nil},
 			`{"service":"srv","name":"ops","sample_rate":0,"type":"trace(0)"}`},
-		{SamplingRule{regexp.MustCompile("srv.[0-9]+]"), nil, 0, 0, 0, "srv", "ops", nil},
+		{SamplingRule{regexp.MustCompile("srv.[0-9]+]"), nil, nil, 0, 0, 0, "srv", "ops", nil},
 			`{"service":"srv","name":"ops","sample_rate":0,"type":"trace(0)"}`},
-		{SamplingRule{regexp.MustCompile("srv.*"), regexp.MustCompile("ops.[0-9]+]"), 0, 0, 0, "", "", nil},
+		{SamplingRule{regexp.MustCompile("srv.*"), regexp.MustCompile("ops.[0-9]+]"), nil, 0, 0, 0, "", "", nil},
 			`{"service":"srv.*","name":"ops.[0-9]+]","sample_rate":0,"type":"trace(0)"}`},
-		{SamplingRule{regexp.MustCompile("srv.[0-9]+]"), regexp.MustCompile("ops.[0-9]+]"), 0.55, 0, 0, "", "", nil},
+		{SamplingRule{regexp.MustCompile("srv.[0-9]+]"), regexp.MustCompile("ops.[0-9]+]"), nil, 0.55, 0, 0, "", "", nil},
 			`{"service":"srv.[0-9]+]","name":"ops.[0-9]+]","sample_rate":0.55,"type":"trace(0)"}`},
-		{SamplingRule{regexp.MustCompile("srv.[0-9]+]"), regexp.MustCompile("ops.[0-9]+]"), 0.55, 0, 1, "", "", nil},
+		{SamplingRule{regexp.MustCompile("srv.[0-9]+]"), regexp.MustCompile("ops.[0-9]+]"), nil, 0.55, 0, 1, "", "", nil},
 			`{"service":"srv.[0-9]+]","name":"ops.[0-9]+]","sample_rate":0.55,"type":"span(1)"}`},
-		{SamplingRule{regexp.MustCompile("srv.[0-9]+]"), regexp.MustCompile("ops.[0-9]+]"), 0.55, 1000, 1, "", "", nil},
+		{SamplingRule{regexp.MustCompile("srv.[0-9]+]"), regexp.MustCompile("ops.[0-9]+]"), nil, 0.55, 1000, 1, "", "", nil},
 			`{"service":"srv.[0-9]+]","name":"ops.[0-9]+]","sample_rate":0.55,"type":"span(1)","max_per_second":1000}`},
+		{SamplingRule{nil, nil, regexp.MustCompile("^GET /api/.*$"), 0.5, 0, 0, "", "", nil},
+			`{"service":"","name":"","resource":"^GET /api/.*$","sample_rate":0.5,"type":"trace(0)"}`},
 	} {
 		m, err := tt.in.MarshalJSON()
 		assert.Nil(t, err)
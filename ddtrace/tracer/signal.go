@@ -0,0 +1,60 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016 Datadog, Inc.
+
+package tracer
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// InstallSignalHandler flushes the traces buffered by the started tracer whenever
+// the process receives one of sigs. It defaults to SIGTERM and os.Interrupt. This is
+// useful for environments such as Kubernetes, where a process is sent SIGTERM shortly
+// before being killed and spans finished in its last seconds would otherwise be lost.
+//
+// The tracer is not stopped, so that the spans finishing while the application drains
+// its in-flight requests are still sent, and the signals are received on a dedicated
+// channel, so handlers registered by the application with signal.Notify receive them
+// exactly once, as usual. Registering a handler disables the default action of the
+// signals though, such as terminating the process. Applications which do not handle
+// sigs themselves should set restoreDefault: the handler then unregisters itself after
+// the first signal, restores the default action of the signals for the whole process,
+// including for the application's handlers, and raises the signal again so that the
+// default action takes place. Signals can not be raised on Windows, where
+// restoreDefault only unregisters the handler, so that the next signal has its default
+// action. The returned function unregisters the handler.
+func InstallSignalHandler(restoreDefault bool, sigs ...os.Signal) (uninstall func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGTERM, os.Interrupt}
+	}
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, sigs...)
+	go func() {
+		for {
+			select {
+			case sig := <-c:
+				Flush()
+				if restoreDefault {
+					signal.Stop(c)
+					raiseDefault(sig)
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(c)
+			close(done)
+		})
+	}
+}
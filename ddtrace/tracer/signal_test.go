@@ -0,0 +1,78 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016 Datadog, Inc.
+
+//go:build !windows
+// +build !windows
+
+package tracer
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/internal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstallSignalHandler(t *testing.T) {
+	// the application's own handler
+	app := make(chan os.Signal, 2)
+	signal.Notify(app, syscall.SIGUSR1)
+	defer signal.Stop(app)
+
+	t.Run("flush", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer, transport, _, stop := startTestTracer(t)
+		defer stop()
+		uninstall := InstallSignalHandler(false, syscall.SIGUSR1)
+		defer uninstall()
+
+		tracer.StartSpan("op").Finish()
+		syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		assert.Equal(syscall.SIGUSR1, <-app)
+		assert.Eventually(func() bool {
+			return transport.Len() == 1
+		}, 2*time.Second, 5*time.Millisecond)
+		assert.Equal(tracer, internal.GetGlobalTracer())
+		select {
+		case <-app:
+			t.Fatal("signal delivered twice")
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("restoreDefault", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer, transport, _, stop := startTestTracer(t)
+		defer stop()
+		// the default action of SIGWINCH is to ignore it
+		uninstall := InstallSignalHandler(true, syscall.SIGWINCH)
+		defer uninstall()
+
+		tracer.StartSpan("op").Finish()
+		syscall.Kill(os.Getpid(), syscall.SIGWINCH)
+		assert.Eventually(func() bool {
+			return transport.Len() == 1
+		}, 2*time.Second, 5*time.Millisecond)
+		assert.Equal(tracer, internal.GetGlobalTracer())
+	})
+
+	t.Run("uninstall", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer, _, _, stop := startTestTracer(t)
+		defer stop()
+		uninstall := InstallSignalHandler(false, syscall.SIGUSR1)
+		uninstall()
+		uninstall() // no-op
+
+		syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		assert.Equal(syscall.SIGUSR1, <-app)
+		assert.Equal(tracer, internal.GetGlobalTracer())
+	})
+}
@@ -0,0 +1,12 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016 Datadog, Inc.
+
+package tracer
+
+import "os"
+
+// raiseDefault does nothing, as signals can not be raised on Windows; the next
+// signal has its default action once the handler is unregistered.
+func raiseDefault(_ os.Signal) {}
@@ -0,0 +1,114 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016 Datadog, Inc.
+
+package tracer
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/internal"
+	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// SpanSnapshot is a copy of a finished span waiting to be sent to the agent, as
+// returned by Snapshot.
+type SpanSnapshot struct {
+	Name     string
+	Service  string
+	Resource string
+	Type     string
+	Start    time.Time
+	Duration time.Duration
+	Meta     map[string]string
+	Metrics  map[string]float64
+	SpanID   uint64
+	TraceID  uint64
+	ParentID uint64
+	Error    bool
+}
+
+// Snapshot returns copies of the spans of the finished traces which are buffered by
+// the tracer, grouped by trace, without removing them from the buffer nor sending
+// them. It covers the traces which were filtered, sampled and kept, waiting for
+// the next flush, but not those being sent at the time, nor the spans which are
+// still in progress. It is meant for diagnostics, such as a debug endpoint exposing
+// in-flight traces: its cost is proportional to the number of buffered spans, which
+// it decodes, and it briefly holds up the tracer's worker, so it must not be called
+// on hot paths. It returns nil when the tracer is not started or when traces are not
+// sent to an agent.
+func Snapshot() [][]SpanSnapshot {
+	t, ok := internal.GetGlobalTracer().(*tracer)
+	if !ok {
+		return nil
+	}
+	if t.config.noWorker {
+		t.manualMu.Lock()
+		defer t.manualMu.Unlock()
+		if t.stopped() {
+			return nil
+		}
+		t.drainQueue()
+		return t.bufferedTraces()
+	}
+	// buffered, so that the worker never blocks on replying to a caller which
+	// gave up because the tracer was stopped meanwhile
+	res := make(chan [][]SpanSnapshot, 1)
+	select {
+	case t.snapshot <- res:
+	case <-t.stop:
+		// the worker may have exited already
+		return nil
+	}
+	select {
+	case traces := <-res:
+		return traces
+	case <-t.stop:
+		return nil
+	}
+}
+
+// bufferedTraces decodes the payload being filled by the writer into snapshots.
+// It must be called from the goroutine adding traces to the writer.
+func (t *tracer) bufferedTraces() [][]SpanSnapshot {
+	w, ok := t.traceWriter.(*agentTraceWriter)
+	if !ok {
+		return nil
+	}
+	p := w.payload
+	if p.itemCount() == 0 {
+		return nil
+	}
+	var traces spanLists
+	r := io.MultiReader(bytes.NewReader(p.header[p.off:]), bytes.NewReader(p.buf.Bytes()))
+	if err := msgp.Decode(r, &traces); err != nil {
+		log.Error("Failed to decode buffered traces: %v", err)
+		return nil
+	}
+	snapshots := make([][]SpanSnapshot, len(traces))
+	for i, trace := range traces {
+		snapshots[i] = make([]SpanSnapshot, len(trace))
+		for j, s := range trace {
+			snapshots[i][j] = SpanSnapshot{
+				Name:     s.Name,
+				Service:  s.Service,
+				Resource: s.Resource,
+				Type:     s.Type,
+				Start:    time.Unix(0, s.Start),
+				Duration: time.Duration(s.Duration),
+				Meta:     s.Meta,
+				Metrics:  s.Metrics,
+				SpanID:   s.SpanID,
+				TraceID:  s.TraceID,
+				ParentID: s.ParentID,
+				Error:    s.Error != 0,
+			}
+		}
+	}
+	return snapshots
+}
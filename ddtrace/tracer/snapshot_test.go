@@ -0,0 +1,82 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016 Datadog, Inc.
+
+package tracer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	for name, opts := range map[string][]StartOption{
+		"worker": nil,
+		"manual": {WithoutWorker()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			tracer, transport, _, stop := startTestTracer(t, opts...)
+			defer stop()
+			assert.Nil(Snapshot())
+
+			root := tracer.StartSpan("web.request", ResourceName("/users"))
+			tracer.StartSpan("db.query", ChildOf(root.Context())).Finish(WithError(errors.New("timeout")))
+			root.Finish()
+			tracer.StartSpan("job").Finish()
+			// in progress, so not buffered
+			tracer.StartSpan("pending")
+
+			traces := Snapshot()
+			assert.Len(traces, 2)
+			assert.Len(traces[0], 2)
+			rs, cs := traces[0][0], traces[0][1]
+			assert.Equal("web.request", rs.Name)
+			assert.Equal("/users", rs.Resource)
+			assert.Equal(root.Context().SpanID(), rs.SpanID)
+			assert.Equal(rs.SpanID, cs.ParentID)
+			assert.True(cs.Error)
+			assert.False(rs.Error)
+			assert.Equal("job", traces[1][0].Name)
+
+			rs.Meta["tampered"] = "yes"
+			again := Snapshot()
+			assert.Len(again, 2, "traces must stay buffered")
+			assert.NotContains(again[0][0].Meta, "tampered")
+			assert.Equal(0, transport.Len(), "traces must not be sent")
+
+			Flush()
+			assert.Equal(2, transport.Len())
+			assert.Nil(Snapshot())
+		})
+	}
+}
+
+func TestSnapshotStop(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		tracer, _, _, stop := startTestTracer(t)
+		tracer.StartSpan("op").Finish()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			Snapshot()
+		}()
+		tracer.Stop()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Snapshot blocked after the tracer was stopped")
+		}
+		stop()
+	}
+
+	// the global tracer may be stopped without being replaced
+	tracer, _, _, stop := startTestTracer(t)
+	defer stop()
+	tracer.Stop()
+	assert.Nil(t, Snapshot())
+}
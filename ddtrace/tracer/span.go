@@ -10,17 +10,20 @@ package tracer
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"math"
 	"os"
 	"reflect"
 	"runtime"
 	"runtime/pprof"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
@@ -75,14 +78,127 @@ type span struct {
 	ParentID uint64             `msg:"parent_id"`         // identifier of the span's direct parent
 	Error    int32              `msg:"error"`             // error status of the span; 0 means no errors
 
-	noDebugStack bool         `msg:"-"` // disables debug stack traces
-	finished     bool         `msg:"-"` // true if the span has been submitted to a tracer.
-	context      *spanContext `msg:"-"` // span propagation context
+	noDebugStack  bool         `msg:"-"` // disables debug stack traces
+	tagValueLimit int          `msg:"-"` // maximum length of tag values set by the user; 0 is the default and negative no limit
+	finished      bool         `msg:"-"` // true if the span has been submitted to a tracer.
+	finishing     uint32       `msg:"-"` // set atomically to 1 by the first call to Finish, which is the only one to take effect
+	context       *spanContext `msg:"-"` // span propagation context
 
 	pprofCtxActive  context.Context `msg:"-"` // contains pprof.WithLabel labels to tell the profiler more about this span
 	pprofCtxRestore context.Context `msg:"-"` // contains pprof.WithLabel labels of the parent span (if any) that need to be restored when this span finishes
 
 	taskEnd func() // ends execution tracer (runtime/trace) task, if started
+
+	links []SpanLink `msg:"-"` // links to other spans, see AddSpanLink
+
+	onFinish []func(Span) `msg:"-"` // callbacks run when the span finishes, see OnFinish
+
+	processors []SpanProcessor `msg:"-"` // processors of the tracer which started the span, see SpanProcessor
+	dropped    bool            `msg:"-"` // reports whether a span processor dropped the span, see SpanProcessor
+}
+
+// spanPool holds spans which were sent, to be reused when span pooling is enabled
+// using WithSpanPooling.
+var spanPool = sync.Pool{
+	New: func() interface{} { return new(span) },
+}
+
+// allocSpan returns a new, empty span. It is taken from spanPool when span
+// pooling is enabled.
+func (t *tracer) allocSpan() *span {
+	if !t.config.spanPooling {
+		return new(span)
+	}
+	return spanPool.Get().(*span)
+}
+
+// recycleSpans resets the given spans and puts them back into spanPool. Their tag
+// maps are kept, emptied, to be reused too. The spans must not be referenced anymore.
+// Their contexts, which may still be held as parents, stop referring to them.
+func recycleSpans(spans []*span) {
+	for _, s := range spans {
+		if c := s.context; c != nil {
+			c.mu.Lock()
+			c.span = nil
+			c.mu.Unlock()
+		}
+		meta, metrics := s.Meta, s.Metrics
+		for k := range meta {
+			delete(meta, k)
+		}
+		for k := range metrics {
+			delete(metrics, k)
+		}
+		*s = span{Meta: meta, Metrics: metrics}
+		spanPool.Put(s)
+	}
+}
+
+// SpanLink is a reference from a span to another span, which is possibly part of
+// a different trace.
+type SpanLink struct {
+	// TraceID is the trace ID of the linked span.
+	TraceID uint64 `json:"trace_id"`
+	// SpanID is the span ID of the linked span.
+	SpanID uint64 `json:"span_id"`
+	// Attributes describe the relationship between the spans.
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+const (
+	// maxTagKeyLength specifies the maximum length of a tag key.
+	maxTagKeyLength = 200
+
+	// defaultMaxTagValueLength specifies the default maximum length of a tag value.
+	defaultMaxTagValueLength = 25000
+
+	// maxArrayTagLength specifies the maximum number of elements of an array tag.
+	maxArrayTagLength = 100
+)
+
+// maxSpanLinks specifies the maximum number of links held by a span.
+const maxSpanLinks = 128
+
+// addLink adds the given link to the span.
+func (s *span) addLink(l SpanLink) {
+	s.Lock()
+	defer s.Unlock()
+	if s.finished {
+		return
+	}
+	if len(s.links) >= maxSpanLinks {
+		log.Debug("Span %d reached the limit of %d links, dropping link to span %d.", s.SpanID, maxSpanLinks, l.SpanID)
+		return
+	}
+	s.links = append(s.links, l)
+}
+
+// addFinishHook registers fn to be called when the span finishes.
+func (s *span) addFinishHook(fn func(Span)) {
+	s.Lock()
+	defer s.Unlock()
+	if s.finished {
+		return
+	}
+	s.onFinish = append(s.onFinish, fn)
+}
+
+// runFinishHooks calls the callbacks registered using OnFinish, at most once.
+func (s *span) runFinishHooks() {
+	s.Lock()
+	hooks := s.onFinish
+	s.onFinish = nil
+	s.Unlock()
+	for _, fn := range hooks {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Error("Finish callback of span %q panicked: %v", s.Name, err)
+				}
+			}()
+			fn(s)
+		}()
+	}
 }
 
 // Context yields the SpanContext for this Span. Note that the return
@@ -104,6 +220,14 @@ func (s *span) BaggageItem(key string) string {
 }
 
 // SetTag adds a set of key/value metadata to the span.
+//
+// A []string value is set as one tag per element, suffixing the key with the
+// element's index, starting at 0: the tags "key.0", "key.1" and so on. Each element
+// is an ordinary string tag, so trace search and facets see one tag per element.
+// Previously, such values were set as a single tag named key and formatted with
+// fmt.Sprint, as in "[a b]"; queries on that tag must now use the indexed keys.
+// Setting a slice replaces any value previously set under key, either as a slice or
+// not, an empty slice sets no tag, and only the first 100 elements are kept.
 func (s *span) SetTag(key string, value interface{}) {
 	s.Lock()
 	defer s.Unlock()
@@ -113,6 +237,27 @@ func (s *span) SetTag(key string, value interface{}) {
 	if s.finished {
 		return
 	}
+	s.setTagLocked(key, value)
+}
+
+// setTags sets all the given tags on the span, locking it only once.
+func (s *span) setTags(tags map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.finished {
+		return
+	}
+	for k, v := range tags {
+		s.setTagLocked(k, v)
+	}
+}
+
+// setTagLocked implements SetTag. The span must be locked by the caller.
+func (s *span) setTagLocked(key string, value interface{}) {
+	if len(key) > maxTagKeyLength {
+		key = truncateString(key, maxTagKeyLength)
+		s.setMetric(keyTruncated, 1)
+	}
 	switch key {
 	case ext.Error:
 		s.setTagError(value, errorConfig{
@@ -124,6 +269,10 @@ func (s *span) SetTag(key string, value interface{}) {
 		s.setTagBool(key, v)
 		return
 	}
+	if v, ok := value.([]string); ok {
+		s.setTagArray(key, v)
+		return
+	}
 	if v, ok := value.(string); ok {
 		if key == ext.ResourceName && s.pprofCtxActive != nil && spanResourcePIISafe(s) {
 			// If the user overrides the resource name for the span,
@@ -135,10 +284,15 @@ func (s *span) SetTag(key string, value interface{}) {
 			s.pprofCtxActive = pprof.WithLabels(s.pprofCtxActive, pprof.Labels(traceprof.TraceEndpoint, v))
 			pprof.SetGoroutineLabels(s.pprofCtxActive)
 		}
-		s.setMeta(key, v)
+		s.setUserMeta(key, v)
 		return
 	}
 	if v, ok := toFloat64(value); ok {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			// such values can not be represented in all encodings; drop them
+			log.Debug("Dropping metric %q of span %d: invalid value %v", key, s.SpanID, v)
+			return
+		}
 		s.setMetric(key, v)
 		return
 	}
@@ -149,17 +303,109 @@ func (s *span) SetTag(key string, value interface{}) {
 					// If .String() panics due to a nil receiver, we want to catch this
 					// and replace the string value with "<nil>", just as Sprintf does.
 					// Other panics should not be handled.
-					s.setMeta(key, "<nil>")
+					s.setUserMeta(key, "<nil>")
 					return
 				}
 				panic(e)
 			}
 		}()
-		s.setMeta(key, v.String())
+		s.setUserMeta(key, v.String())
 		return
 	}
 	// not numeric, not a string, not a fmt.Stringer, not a bool, and not an error
-	s.setMeta(key, fmt.Sprint(value))
+	s.setUserMeta(key, fmt.Sprint(value))
+}
+
+// setTagArray sets an array tag as one tag per element, keyed by the element's
+// index, truncating it to maxArrayTagLength elements.
+func (s *span) setTagArray(key string, v []string) {
+	// remove the elements of a previous, possibly longer, value
+	delete(s.Meta, key)
+	delete(s.Metrics, key)
+	for k := range s.Meta {
+		if isArrayTagKey(k, key) {
+			delete(s.Meta, k)
+		}
+	}
+	if len(v) > maxArrayTagLength {
+		v = v[:maxArrayTagLength]
+		s.setMetric(keyTruncated, 1)
+	}
+	for i, e := range v {
+		s.setUserMeta(key+"."+strconv.Itoa(i), e)
+	}
+}
+
+// isArrayTagKey reports whether k is the key of an element of the array tag key.
+func isArrayTagKey(k, key string) bool {
+	if !strings.HasPrefix(k, key+".") || len(k) == len(key)+1 {
+		return false
+	}
+	i := k[len(key)+1:]
+	for _, c := range i {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// setRuntimeMetrics sets a snapshot of the Go runtime's state as metrics on the span.
+// It is expensive, as reading memory statistics stops the world.
+func setRuntimeMetrics(s *span) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	s.setMetric("runtime.go.num_goroutine", float64(runtime.NumGoroutine()))
+	s.setMetric("runtime.go.mem_stats.heap_alloc", float64(ms.HeapAlloc))
+}
+
+// setUserMeta sets a string tag given by the user, truncating values which exceed
+// the limit set using WithMaxTagValueLength.
+func (s *span) setUserMeta(key, v string) {
+	if n := s.maxTagValueLength(); n > 0 && len(v) > n {
+		v = truncateString(v, n)
+		s.setMetric(keyTruncated, 1)
+	}
+	s.setMeta(key, v)
+}
+
+// maxTagValueLength returns the maximum length of the tag values of s, as configured
+// on the tracer which started it, or zero if there is no limit.
+func (s *span) maxTagValueLength() int {
+	switch n := s.tagValueLimit; {
+	case n == 0:
+		return defaultMaxTagValueLength
+	case n < 0:
+		return 0
+	default:
+		return n
+	}
+}
+
+// tagValueLimit returns the value of span.tagValueLimit corresponding to the given
+// limit set using WithMaxTagValueLength.
+func tagValueLimit(n int) int {
+	if n <= 0 {
+		return -1
+	}
+	return n
+}
+
+// truncateString shortens s to at most n bytes, marking the truncation with an
+// ellipsis. It does not split multi-byte UTF-8 characters.
+func truncateString(s string, n int) string {
+	const ellipsis = "..."
+	if len(s) <= n {
+		return s
+	}
+	if n <= len(ellipsis) {
+		return ellipsis[:n]
+	}
+	i := n - len(ellipsis)
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return s[:i] + ellipsis
 }
 
 // setSamplingPriority locks then span, then updates the sampling priority.
@@ -371,6 +617,15 @@ func (s *span) setMetric(key string, v float64) {
 // Finish closes this Span (but not its children) providing the duration
 // of its part of the tracing session.
 func (s *span) Finish(opts ...ddtrace.FinishOption) {
+	if !atomic.CompareAndSwapUint32(&s.finishing, 0, 1) {
+		// Finish is idempotent; a span can only be submitted once, even when
+		// several goroutines race to finish it.
+		s.RLock()
+		name := s.Name
+		s.RUnlock()
+		log.Debug("Span %q was already finished; ignoring subsequent call to Finish.", name)
+		return
+	}
 	t := now()
 	if len(opts) > 0 {
 		cfg := ddtrace.FinishConfig{
@@ -395,12 +650,19 @@ func (s *span) Finish(opts ...ddtrace.FinishOption) {
 	if s.taskEnd != nil {
 		s.taskEnd()
 	}
+	s.runFinishHooks()
+	if len(s.processors) > 0 {
+		s.processEnd()
+	}
+	// s may be recycled as soon as it is finished when span pooling is enabled, so
+	// it must not be accessed anymore past this point.
+	restore := s.pprofCtxRestore
 	s.finish(t)
 
-	if s.pprofCtxRestore != nil {
+	if restore != nil {
 		// Restore the labels of the parent span so any CPU samples after this
 		// point are attributed correctly.
-		pprof.SetGoroutineLabels(s.pprofCtxRestore)
+		pprof.SetGoroutineLabels(restore)
 	}
 }
 
@@ -420,26 +682,57 @@ func (s *span) SetOperationName(operationName string) {
 
 func (s *span) finish(finishTime int64) {
 	s.Lock()
-	defer s.Unlock()
+	tr, ft := s.finishLocked(finishTime)
+	s.Unlock()
+	if ft != nil {
+		// the trace is only pushed once s is unlocked: the tracer may recycle
+		// its spans as soon as it is sent when span pooling is enabled.
+		tr.pushTrace(ft)
+	}
+}
+
+// finishLocked marks s as finished. It returns the tracer and the trace to push to
+// it when s was the last unfinished span of its trace. s must be locked.
+func (s *span) finishLocked(finishTime int64) (*tracer, *finishedTrace) {
 	// We don't lock spans when flushing, so we could have a data race when
 	// modifying a span as it's being flushed. This protects us against that
 	// race, since spans are marked `finished` before we flush them.
 	if s.finished {
 		// already finished
-		return
+		return nil, nil
 	}
 	if s.Duration == 0 {
 		s.Duration = finishTime - s.Start
 	}
 	if s.Duration < 0 {
+		// the clock went backwards or the finish time given precedes the start
+		log.Debug("Span %q finished %v before it started; setting its duration to 0.", s.Name, time.Duration(-s.Duration))
+		s.setMetric(keyClockSkew, 1)
 		s.Duration = 0
+	} else if s.Duration > maxSpanDuration {
+		// most likely a bad start or finish time; the duration is kept as is
+		log.Debug("Span %q lasted %v, more than %v; flagging it.", s.Name, time.Duration(s.Duration), time.Duration(maxSpanDuration))
+		s.setMetric(keyLongDuration, 1)
 	}
 	s.finished = true
+	if len(s.links) > 0 {
+		// the v0.4 payload has no field for links; they are sent as a tag instead
+		if bs, err := json.Marshal(s.links); err == nil {
+			s.setMeta(keySpanLinks, string(bs))
+		}
+	}
 
 	keep := true
 	if t, ok := internal.GetGlobalTracer().(*tracer); ok {
 		// we have an active tracer
-		if t.config.canComputeStats() && shouldComputeStats(s) {
+		if fn := t.config.resourceObfuscator; fn != nil {
+			// obfuscated before computing stats, so that both group the same way
+			s.Resource = fn(s.Resource)
+		}
+		if r := t.config.spanRuntimeMetricsRate; r > 0 && s.context.trace.root == s && sampledByRate(s.SpanID, r) {
+			setRuntimeMetrics(s)
+		}
+		if t.config.canComputeStats() && shouldComputeStats(s) && !s.context.trace.isIgnored() {
 			// the agent supports computed stats
 			select {
 			case t.stats.In <- newAggregableSpan(s, t.obfuscator):
@@ -452,12 +745,16 @@ func (s *span) finish(finishTime int64) {
 			// the agent supports dropping p0's in the client
 			keep = shouldKeep(s)
 		}
+		if s.Error > 0 && !t.config.noKeepErrors {
+			// errors are too valuable to be sampled out
+			s.context.trace.keepErrored()
+		}
 	}
 	if keep {
 		// a single kept span keeps the whole trace.
 		s.context.trace.keep()
 	}
-	s.context.finish()
+	return s.context.finish()
 }
 
 // newAggregableSpan creates a new summary for the span s, within an application
@@ -558,38 +855,87 @@ func (s *span) String() string {
 		fmt.Sprintf("Type: %s", s.Type),
 		"Tags:",
 	}
-	for key, val := range s.Meta {
-		lines = append(lines, fmt.Sprintf("\t%s:%s", key, val))
+	// tags are sorted by key to keep the output stable
+	keys := make([]string, 0, len(s.Meta))
+	for key := range s.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("\t%s:%s", key, s.Meta[key]))
 	}
-	for key, val := range s.Metrics {
-		lines = append(lines, fmt.Sprintf("\t%s:%f", key, val))
+	keys = keys[:0]
+	for key := range s.Metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("\t%s:%f", key, s.Metrics[key]))
 	}
 	return strings.Join(lines, "\n")
 }
 
+// MarshalJSON implements json.Marshaler. It encodes the span using the same
+// field names as the payload sent to the agent. A span which has not finished
+// yet has a duration of zero. As with encoding/json, it fails when a metric
+// is NaN or infinite.
+func (s *span) MarshalJSON() ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return json.Marshal(struct {
+		Name     string             `json:"name"`
+		Service  string             `json:"service"`
+		Resource string             `json:"resource"`
+		Type     string             `json:"type"`
+		Start    int64              `json:"start"`
+		Duration int64              `json:"duration"`
+		Meta     map[string]string  `json:"meta,omitempty"`
+		Metrics  map[string]float64 `json:"metrics,omitempty"`
+		SpanID   uint64             `json:"span_id"`
+		TraceID  uint64             `json:"trace_id"`
+		ParentID uint64             `json:"parent_id"`
+		Error    int32              `json:"error"`
+	}{
+		Name:     s.Name,
+		Service:  s.Service,
+		Resource: s.Resource,
+		Type:     s.Type,
+		Start:    s.Start,
+		Duration: s.Duration,
+		Meta:     s.Meta,
+		Metrics:  s.Metrics,
+		SpanID:   s.SpanID,
+		TraceID:  s.TraceID,
+		ParentID: s.ParentID,
+		Error:    s.Error,
+	})
+}
+
+// correlationTags returns the service, environment and version which logs are
+// correlated with, as configured in the global tracer or in the environment.
+func correlationTags() (service, env, version string) {
+	service = globalconfig.ServiceName()
+	if tr, ok := internal.GetGlobalTracer().(*tracer); ok {
+		return service, tr.config.env, tr.config.version
+	}
+	return service, os.Getenv("DD_ENV"), os.Getenv("DD_VERSION")
+}
+
 // Format implements fmt.Formatter.
 func (s *span) Format(f fmt.State, c rune) {
 	switch c {
 	case 's':
 		fmt.Fprint(f, s.String())
 	case 'v':
-		if svc := globalconfig.ServiceName(); svc != "" {
+		svc, env, version := correlationTags()
+		if svc != "" {
 			fmt.Fprintf(f, "dd.service=%s ", svc)
 		}
-		if tr, ok := internal.GetGlobalTracer().(*tracer); ok {
-			if tr.config.env != "" {
-				fmt.Fprintf(f, "dd.env=%s ", tr.config.env)
-			}
-			if tr.config.version != "" {
-				fmt.Fprintf(f, "dd.version=%s ", tr.config.version)
-			}
-		} else {
-			if env := os.Getenv("DD_ENV"); env != "" {
-				fmt.Fprintf(f, "dd.env=%s ", env)
-			}
-			if v := os.Getenv("DD_VERSION"); v != "" {
-				fmt.Fprintf(f, "dd.version=%s ", v)
-			}
+		if env != "" {
+			fmt.Fprintf(f, "dd.env=%s ", env)
+		}
+		if version != "" {
+			fmt.Fprintf(f, "dd.version=%s ", version)
 		}
 		fmt.Fprintf(f, `dd.trace_id="%d" dd.span_id="%d"`, s.TraceID, s.SpanID)
 	default:
@@ -621,8 +967,36 @@ const (
 	keySingleSpanSamplingMPS = "_dd.span_sampling.max_per_second"
 	// keyPropagatedUserID holds the propagated user identifier, if user id propagation is enabled.
 	keyPropagatedUserID = "_dd.p.usr.id"
+	// keySpansTruncated is set on traces which exceeded the limit set using WithMaxSpansPerTrace.
+	keySpansTruncated = "_dd.spans_truncated"
+	// keySpanLinks holds the links to other spans, encoded as JSON.
+	keySpanLinks = "_dd.span_links"
+	// keyTruncated is set on spans having tags which were truncated for exceeding
+	// maxTagKeyLength, maxArrayTagLength or the limit set using WithMaxTagValueLength.
+	keyTruncated = "_dd.truncated"
+	// keyCaller holds the file:line at which the span was started, when enabled
+	// using WithCaptureCaller.
+	keyCaller = "_dd.caller"
+	// keyClockSkew is set on spans which finished before they started, such as after
+	// the clock went backwards; their duration is set to 0.
+	keyClockSkew = "_dd.clock_skew"
+	// keyLongDuration is set on spans lasting more than maxSpanDuration, which
+	// usually denotes a bad start or finish time.
+	keyLongDuration = "_dd.long_duration"
+	// keySpanCount holds the number of spans sent for a trace, see WithTraceSummary.
+	keySpanCount = "_dd.span_count"
+	// keyTraceError is set on local roots of traces having a span with an error,
+	// see WithTraceSummary.
+	keyTraceError = "_dd.trace_error"
+	// keyTracerVersion holds the version of the tracer which started a local root span.
+	keyTracerVersion = "_dd.tracer_version"
+	// keyRuntime holds the version of the Go runtime of a local root span.
+	keyRuntime = "_dd.runtime"
 )
 
+// maxSpanDuration is the duration above which spans are flagged using keyLongDuration.
+const maxSpanDuration = int64(24 * time.Hour)
+
 // The following set of tags is used for user monitoring and set through calls to span.setUser().
 const (
 	keyUserID        = "usr.id"
@@ -6,15 +6,22 @@
 package tracer
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/internal"
+	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/samplernames"
 
 	"github.com/DataDog/datadog-agent/pkg/obfuscate"
@@ -102,6 +109,72 @@ func TestSpanFinishTwice(t *testing.T) {
 	tracer.awaitPayload(t, 1)
 }
 
+func TestSpanFinishRace(t *testing.T) {
+	assert := assert.New(t)
+	tracer, transport, flush, stop := startTestTracer(t)
+	defer stop()
+
+	var hooks, ends int32
+	proc := funcProcessor{onEnd: func(Span) bool {
+		atomic.AddInt32(&ends, 1)
+		return false
+	}}
+	tracer.config.spanProcessors = []SpanProcessor{proc}
+	span := tracer.StartSpan("web.request")
+	OnFinish(span, func(Span) { atomic.AddInt32(&hooks, 1) })
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			span.Finish(WithError(errors.New("test error")))
+		}()
+	}
+	close(start)
+	wg.Wait()
+	flush(1)
+
+	assert.EqualValues(1, atomic.LoadInt32(&hooks), "finish hooks must run once")
+	assert.EqualValues(1, atomic.LoadInt32(&ends), "span processors must run once")
+	assert.EqualValues(1, atomic.LoadUint32(&tracer.spansFinished))
+	assert.Equal(1, transport.Len())
+	assert.Len(transport.Traces()[0], 1)
+}
+
+func TestSpanFinishConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	tracer, _, _, stop := startTestTracer(t)
+	defer stop()
+	tw := newTestTraceWriter()
+	tracer.traceWriter = tw
+
+	span := tracer.newRootSpan("pylons.request", "pylons", "/")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			span.Finish(WithError(errors.New("test error")))
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(1, atomic.LoadUint32(&tracer.spansFinished))
+	timeout := time.After(time.Second * timeMultiplicator)
+	for len(tw.Flushed()) == 0 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for trace to be flushed")
+		default:
+			tracer.flushSync()
+		}
+	}
+	tracer.flushSync()
+	assert.Len(tw.Flushed(), 1)
+}
+
 func TestShouldDrop(t *testing.T) {
 	for _, tt := range []struct {
 		prio   int
@@ -206,6 +279,30 @@ func TestSpanFinishWithNegativeDuration(t *testing.T) {
 	span.Start = startTime.UnixNano()
 	span.Finish(FinishTime(finishTime))
 	assert.Equal(int64(0), span.Duration)
+	assert.Equal(1.0, span.Metrics[keyClockSkew])
+}
+
+func TestSpanFinishWithZeroDuration(t *testing.T) {
+	assert := assert.New(t)
+	span := newBasicSpan("web.request")
+	span.Finish(FinishTime(time.Unix(0, span.Start)))
+	assert.Equal(int64(0), span.Duration)
+	assert.NotContains(span.Metrics, keyClockSkew)
+	assert.NotContains(span.Metrics, keyLongDuration)
+}
+
+func TestSpanFinishWithLongDuration(t *testing.T) {
+	assert := assert.New(t)
+	span := newBasicSpan("web.request")
+	span.Start = 0
+	span.Finish()
+	assert.True(span.Duration > maxSpanDuration, "the duration must be kept")
+	assert.Equal(1.0, span.Metrics[keyLongDuration])
+	assert.NotContains(span.Metrics, keyClockSkew)
+
+	span = newBasicSpan("web.request")
+	span.Finish(FinishTime(time.Unix(0, span.Start).Add(time.Hour)))
+	assert.NotContains(span.Metrics, keyLongDuration)
 }
 
 func TestSpanFinishWithError(t *testing.T) {
@@ -332,6 +429,55 @@ func TestSpanSetTag(t *testing.T) {
 	})
 }
 
+func TestSpanSetTagArray(t *testing.T) {
+	assert := assert.New(t)
+	sp := newBasicSpan("web.request")
+	sp.SetTag("error.fingerprint", []string{"b", "a", "c"})
+	sp.SetTag("empty", []string{})
+	assert.Equal("b", sp.Meta["error.fingerprint.0"])
+	assert.Equal("a", sp.Meta["error.fingerprint.1"])
+	assert.Equal("c", sp.Meta["error.fingerprint.2"])
+	assert.NotContains(sp.Meta, "error.fingerprint")
+	assert.NotContains(sp.Meta, "error.fingerprint.3")
+	assert.NotContains(sp.Meta, "empty")
+	assert.NotContains(sp.Meta, "empty.0")
+	assert.NotContains(sp.Metrics, keyTruncated)
+
+	// the elements survive encoding in order
+	p := newPayload()
+	assert.NoError(p.push(spanList{sp}))
+	traces, err := decode(p)
+	assert.NoError(err)
+	for i, v := range []string{"b", "a", "c"} {
+		assert.Equal(v, traces[0][0].Meta[fmt.Sprintf("error.fingerprint.%d", i)])
+	}
+
+	large := make([]string, maxArrayTagLength+10)
+	for i := range large {
+		large[i] = strconv.Itoa(i)
+	}
+	sp.SetTag("large", large)
+	assert.Equal(strconv.Itoa(maxArrayTagLength-1), sp.Meta[fmt.Sprintf("large.%d", maxArrayTagLength-1)])
+	assert.NotContains(sp.Meta, fmt.Sprintf("large.%d", maxArrayTagLength))
+	assert.Equal(1.0, sp.Metrics[keyTruncated])
+}
+
+func TestSpanSetTagArrayOverwrite(t *testing.T) {
+	assert := assert.New(t)
+	sp := newBasicSpan("web.request")
+	sp.SetTag("error.fingerprint", "plain")
+	sp.SetTag("error.fingerprint.name", "kept")
+	sp.SetTag("error.fingerprint", []string{"a", "b", "c"})
+	assert.NotContains(sp.Meta, "error.fingerprint")
+	sp.SetTag("error.fingerprint", []string{"d"})
+	assert.Equal("d", sp.Meta["error.fingerprint.0"])
+	assert.NotContains(sp.Meta, "error.fingerprint.1")
+	assert.NotContains(sp.Meta, "error.fingerprint.2")
+	assert.Equal("kept", sp.Meta["error.fingerprint.name"])
+	sp.SetTag("error.fingerprint", []string{})
+	assert.NotContains(sp.Meta, "error.fingerprint.0")
+}
+
 func TestSpanSetTagError(t *testing.T) {
 	assert := assert.New(t)
 
@@ -407,6 +553,465 @@ func TestSpanString(t *testing.T) {
 	assert.NotEqual("", span.String())
 }
 
+func TestSpanStringStable(t *testing.T) {
+	span := newBasicSpan("web.request")
+	for _, k := range []string{"c", "a", "d", "b"} {
+		span.SetTag(k, k)
+		span.SetTag(k+".num", 1)
+	}
+	str := span.String()
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, str, span.String())
+	}
+	assert.Contains(t, str, "\ta:a\n\tb:b\n\tc:c\n\td:d\n")
+}
+
+func TestTruncateString(t *testing.T) {
+	for _, tt := range []struct {
+		in, out string
+		n       int
+	}{
+		{"hello", "hello", 5},
+		{"hello world", "hello...", 8},
+		{"hello", "..", 2},
+		// "é" is 2 bytes and "世" is 3 bytes; runes are never split
+		{"ééééé", "éé...", 8},
+		{"ééééé", "é...", 6},
+		{"世界世界", "世...", 8},
+		{"世界世界", "...", 5},
+	} {
+		got := truncateString(tt.in, tt.n)
+		assert.Equal(t, tt.out, got)
+		assert.True(t, utf8.ValidString(got))
+		assert.LessOrEqual(t, len(got), tt.n)
+	}
+}
+
+func TestSpanSetTagTruncated(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		assert := assert.New(t)
+		span := newBasicSpan("web.request")
+		span.SetTag("short", "value")
+		assert.NotContains(span.Metrics, keyTruncated)
+
+		span.SetTag("long", strings.Repeat("x", defaultMaxTagValueLength+1))
+		assert.Len(span.Meta["long"], defaultMaxTagValueLength)
+		assert.True(strings.HasSuffix(span.Meta["long"], "..."))
+		assert.Equal(1., span.Metrics[keyTruncated])
+
+		key := strings.Repeat("k", maxTagKeyLength+1)
+		span.SetTag(key, 1)
+		assert.Contains(span.Metrics, key[:maxTagKeyLength-3]+"...")
+	})
+
+	t.Run("WithMaxTagValueLength", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer, _, _, stop := startTestTracer(t, WithMaxTagValueLength(10))
+		defer stop()
+		span := tracer.StartSpan("web.request", ResourceName("SELECT * FROM users")).(*span)
+		assert.Equal("SELECT ...", span.Resource)
+		span.SetTag("body", "ééééééé")
+		assert.Equal("ééé...", span.Meta["body"])
+		assert.Equal(1., span.Metrics[keyTruncated])
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		tracer, _, _, stop := startTestTracer(t, WithMaxTagValueLength(0))
+		defer stop()
+		span := tracer.StartSpan("web.request").(*span)
+		long := strings.Repeat("x", defaultMaxTagValueLength+1)
+		span.SetTag("long", long)
+		assert.Equal(t, long, span.Meta["long"])
+	})
+
+	t.Run("own-tracer", func(t *testing.T) {
+		assert := assert.New(t)
+		_, _, _, stop := startTestTracer(t, WithMaxTagValueLength(0))
+		defer stop()
+		// the limit is that of the tracer which started the span, rather than
+		// that of the global tracer, even once it is replaced
+		own := newUnstartedTracer(WithMaxTagValueLength(10))
+		sp := own.StartSpan("web.request").(*span)
+		sp.SetTag("body", "0123456789abc")
+		assert.Equal("0123456...", sp.Meta["body"])
+
+		open := StartSpan("web.request").(*span)
+		_, _, _, stop2 := startTestTracer(t, WithMaxTagValueLength(10))
+		defer stop2()
+		long := strings.Repeat("x", 20)
+		open.SetTag("long", long)
+		assert.Equal(long, open.Meta["long"])
+	})
+}
+
+func TestSpanRuntimeMetrics(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer, _, _, stop := startTestTracer(t, WithSpanRuntimeMetrics(1))
+		defer stop()
+		root := tracer.StartSpan("root").(*span)
+		child := tracer.StartSpan("child", ChildOf(root.Context())).(*span)
+		child.Finish()
+		root.Finish()
+		assert.Greater(root.Metrics["runtime.go.num_goroutine"], 0.)
+		assert.Greater(root.Metrics["runtime.go.mem_stats.heap_alloc"], 0.)
+		assert.NotContains(child.Metrics, "runtime.go.num_goroutine")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		tracer, _, _, stop := startTestTracer(t)
+		defer stop()
+		root := tracer.StartSpan("root").(*span)
+		root.Finish()
+		assert.NotContains(t, root.Metrics, "runtime.go.num_goroutine")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		c := newConfig(WithSpanRuntimeMetrics(2))
+		assert.Zero(t, c.spanRuntimeMetricsRate)
+	})
+}
+
+func TestKeepErrors(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer, transport, flush, stop := startTestTracer(t, WithSampler(NewRateSampler(0)))
+		defer stop()
+		root := tracer.StartSpan("root").(*span)
+		child := tracer.StartSpan("child", ChildOf(root.Context())).(*span)
+		assert.Equal(decisionDrop, root.context.trace.samplingDecision)
+		child.Finish(WithError(errors.New("boom")))
+		root.Finish()
+		flush(1)
+
+		traces := transport.Traces()
+		assert.Len(traces, 1)
+		assert.Len(traces[0], 2)
+		assert.Equal(float64(ext.PriorityUserKeep), root.Metrics[keySamplingPriority])
+		assert.NotContains(root.Meta, keyDecisionMaker)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer, transport, flush, stop := startTestTracer(t, WithSampler(NewRateSampler(0)), WithKeepErrors(false))
+		defer stop()
+		root := tracer.StartSpan("root").(*span)
+		child := tracer.StartSpan("child", ChildOf(root.Context())).(*span)
+		child.Finish(WithError(errors.New("boom")))
+		root.Finish()
+		flush(0)
+		assert.Len(transport.Traces(), 0)
+	})
+
+	t.Run("manual-drop", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer, transport, flush, stop := startTestTracer(t)
+		defer stop()
+		root := tracer.StartSpan("root", Tag(ext.ManualDrop, true)).(*span)
+		child := tracer.StartSpan("child", ChildOf(root.Context())).(*span)
+		child.Finish(WithError(errors.New("boom")))
+		root.Finish()
+		flush(1)
+
+		// the user's decision to drop the trace stands
+		assert.Equal(float64(ext.PriorityUserReject), root.Metrics[keySamplingPriority])
+		assert.NotEqual("-4", root.Meta[keyDecisionMaker])
+		traces := transport.Traces()
+		assert.Len(traces, 1)
+		assert.Equal(float64(ext.PriorityUserReject), traces[0][0].Metrics[keySamplingPriority])
+	})
+}
+
+func TestSetTags(t *testing.T) {
+	assert := assert.New(t)
+	span := newBasicSpan("web.request")
+	SetTags(span, map[string]string{
+		"http.method":        "GET",
+		ext.ResourceName:     "/users",
+		ext.ManualKeep:       "true",
+		ext.SamplingPriority: "2",
+	})
+	assert.Equal("GET", span.Meta["http.method"])
+	assert.Equal("/users", span.Resource)
+	assert.NotContains(span.Meta, ext.ResourceName)
+
+	SetTags(span, nil)
+	SetTags(nil, map[string]string{"key": "value"})
+	span.Finish()
+	SetTags(span, map[string]string{"key": "value"})
+	assert.NotContains(span.Meta, "key")
+}
+
+func TestSetStructTags(t *testing.T) {
+	type node struct {
+		Name string
+		Next *node
+	}
+	type address struct {
+		City  string `trace:"city"`
+		Inner struct{ Deep string }
+	}
+	type request struct {
+		User     string `trace:"user.id"`
+		Retries  int    `trace:"retries,keepzero"`
+		Empty    string
+		Token    string `trace:"-"`
+		Admin    bool
+		Ratio    float64
+		Size     *uint32
+		Missing  *int
+		Started  time.Time
+		Address  address
+		Loop     *node
+		Any      interface{}
+		Callback func()
+		Events   chan int
+		Labels   []string
+		secret   string
+	}
+	size := uint32(7)
+	loop := &node{Name: "a"}
+	loop.Next = loop
+	start := time.Unix(0, 0).UTC()
+	req := &request{
+		User:     "u1",
+		Token:    "t",
+		Admin:    true,
+		Ratio:    0.5,
+		Size:     &size,
+		Started:  start,
+		Address:  address{City: "Paris", Inner: struct{ Deep string }{"x"}},
+		Loop:     loop,
+		Any:      "value",
+		Callback: func() {},
+		Events:   make(chan int),
+		Labels:   []string{"a"},
+		secret:   "s",
+	}
+
+	assert := assert.New(t)
+	sp := newBasicSpan("web.request")
+	SetStructTags(sp, req, "req")
+	assert.Equal(map[string]string{
+		"req.user.id":      "u1",
+		"req.Admin":        "true",
+		"req.Started":      start.String(),
+		"req.Address.city": "Paris",
+		"req.Loop.Name":    "a",
+		"req.Any":          "value",
+	}, sp.Meta)
+	assert.Equal(0.0, sp.Metrics["req.retries"])
+	assert.Equal(0.5, sp.Metrics["req.Ratio"])
+	assert.Equal(7.0, sp.Metrics["req.Size"])
+	assert.NotContains(sp.Metrics, "req.Missing")
+	// nested structs are only flattened one level deep
+	assert.NotContains(sp.Meta, "req.Address.Inner.Deep")
+
+	sp = newBasicSpan("web.request")
+	SetStructTags(sp, request{User: "u2"}, "")
+	assert.Equal("u2", sp.Meta["user.id"])
+
+	assert.NotPanics(func() {
+		SetStructTags(nil, req, "")
+		SetStructTags(sp, nil, "")
+		SetStructTags(sp, (*request)(nil), "")
+		SetStructTags(sp, 42, "")
+	})
+}
+
+func BenchmarkSetTags(b *testing.B) {
+	tags := map[string]string{
+		"http.method":      "GET",
+		"http.url":         "/users/1",
+		"http.status_code": "200",
+		"http.useragent":   "test",
+		"http.host":        "example.com",
+		"component":        "net/http",
+	}
+	b.Run("SetTag", func(b *testing.B) {
+		span := newBasicSpan("web.request")
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for k, v := range tags {
+				span.SetTag(k, v)
+			}
+		}
+	})
+	b.Run("SetTags", func(b *testing.B) {
+		span := newBasicSpan("web.request")
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			SetTags(span, tags)
+		}
+	})
+}
+
+func TestSpanDurationFinished(t *testing.T) {
+	assert := assert.New(t)
+	tracer, _, _, stop := startTestTracer(t)
+	defer stop()
+
+	start := time.Now().Add(-time.Minute)
+	sp := tracer.StartSpan("op", StartTime(start))
+	assert.False(SpanFinished(sp))
+	d := SpanDuration(sp)
+	assert.GreaterOrEqual(d, time.Minute)
+	assert.Less(d, 2*time.Minute)
+
+	sp.Finish(FinishTime(start.Add(time.Second)))
+	assert.True(SpanFinished(sp))
+	assert.Equal(time.Second, SpanDuration(sp))
+
+	assert.False(SpanFinished(nil))
+	assert.Zero(SpanDuration(nil))
+	assert.False(SpanFinished(&internal.NoopSpan{}))
+	assert.Zero(SpanDuration(&internal.NoopSpan{}))
+}
+
+func TestOnFinish(t *testing.T) {
+	tracer, _, _, stop := startTestTracer(t)
+	defer stop()
+	defer log.UseLogger(new(testLogger))()
+	assert := assert.New(t)
+
+	var calls []string
+	sp := tracer.StartSpan("op")
+	OnFinish(sp, func(s Span) {
+		calls = append(calls, "first")
+		assert.False(SpanFinished(s))
+		s.SetTag("hook", "set")
+	})
+	OnFinish(sp, func(Span) { panic("boom") })
+	OnFinish(sp, func(Span) { calls = append(calls, "last") })
+	OnFinish(sp, nil)
+	sp.Finish()
+	sp.Finish()
+	assert.Equal([]string{"first", "last"}, calls)
+	assert.Equal("set", sp.(*span).Meta["hook"])
+
+	// callbacks can't be registered on finished spans
+	OnFinish(sp, func(Span) { calls = append(calls, "late") })
+	assert.Len(calls, 2)
+	assert.Nil(sp.(*span).onFinish)
+	OnFinish(&internal.NoopSpan{}, func(Span) {})
+}
+
+func TestStartChild(t *testing.T) {
+	tracer, _, _, stop := startTestTracer(t)
+	defer stop()
+	assert := assert.New(t)
+
+	parent := tracer.StartSpan("web.request", ServiceName("web"), Tag(ext.ManualKeep, true)).(*span)
+	child := StartChild(parent, "db.query", ResourceName("SELECT 1")).(*span)
+	assert.Equal(parent.TraceID, child.TraceID)
+	assert.Equal(parent.SpanID, child.ParentID)
+	assert.Equal("web", child.Service)
+	assert.Equal("SELECT 1", child.Resource)
+	p, ok := child.context.samplingPriority()
+	assert.True(ok)
+	assert.Equal(ext.PriorityUserKeep, p)
+
+	assert.Equal(internal.NoopSpan{}, StartChild(nil, "db.query"))
+	assert.Equal(internal.NoopSpan{}, StartChild(internal.NoopSpan{}, "db.query"))
+}
+
+func TestFinishTree(t *testing.T) {
+	tracer, transport, flush, stop := startTestTracer(t)
+	defer stop()
+	assert := assert.New(t)
+
+	root := tracer.StartSpan("web.request")
+	handler := tracer.StartSpan("handler", ChildOf(root.Context()))
+	done := tracer.StartSpan("cache.get", ChildOf(handler.Context()))
+	done.Finish()
+	query := tracer.StartSpan("db.query", ChildOf(handler.Context()))
+	rows := tracer.StartSpan("db.rows", ChildOf(query.Context()))
+	sibling := tracer.StartSpan("sibling", ChildOf(root.Context()))
+
+	err := errors.New("request aborted")
+	FinishTree(handler, err)
+	for _, s := range []Span{handler, query, rows} {
+		assert.True(SpanFinished(s))
+		assert.Equal(err.Error(), s.(*span).Meta[ext.ErrorMsg])
+	}
+	// finished descendants and other spans are left alone
+	assert.NotContains(done.(*span).Meta, ext.ErrorMsg)
+	assert.False(SpanFinished(sibling))
+	assert.False(SpanFinished(root))
+
+	sibling.Finish()
+	FinishTree(root, nil)
+	assert.Zero(root.(*span).Error)
+	flush(1)
+	assert.Len(transport.Traces()[0], 6)
+	FinishTree(&internal.NoopSpan{}, err)
+}
+
+func TestAddSpanLink(t *testing.T) {
+	assert := assert.New(t)
+	span := newBasicSpan("batch.process")
+	AddSpanLink(span, 1, 2, map[string]string{"message.id": "a"})
+	AddSpanLink(span, 3, 4, nil)
+	AddSpanLink(nil, 5, 6, nil)
+	span.Finish()
+	AddSpanLink(span, 7, 8, nil)
+
+	var links []SpanLink
+	assert.NoError(json.Unmarshal([]byte(span.Meta[keySpanLinks]), &links))
+	assert.Equal([]SpanLink{
+		{TraceID: 1, SpanID: 2, Attributes: map[string]string{"message.id": "a"}},
+		{TraceID: 3, SpanID: 4},
+	}, links)
+
+	// links are bounded
+	span = newBasicSpan("batch.process")
+	for i := 0; i < maxSpanLinks+10; i++ {
+		AddSpanLink(span, uint64(i), uint64(i), nil)
+	}
+	assert.Len(span.links, maxSpanLinks)
+
+	// no links, no tag
+	span = newBasicSpan("batch.process")
+	span.Finish()
+	assert.NotContains(span.Meta, keySpanLinks)
+}
+
+func TestSpanMarshalJSON(t *testing.T) {
+	t.Run("finished", func(t *testing.T) {
+		assert := assert.New(t)
+		span := newSpan("web.request", "web-service", "/", 1, 2, 3)
+		span.Start = 10
+		span.SetTag(ext.SpanType, "web")
+		span.SetTag("key", "value")
+		span.SetTag("num", 1.5)
+		span.Finish(FinishTime(time.Unix(0, 30)), WithError(errors.New("test error")))
+
+		var got map[string]interface{}
+		bs, err := json.Marshal(span)
+		assert.NoError(err)
+		assert.NoError(json.Unmarshal(bs, &got))
+		assert.Equal("web.request", got["name"])
+		assert.Equal("web-service", got["service"])
+		assert.Equal("/", got["resource"])
+		assert.Equal("web", got["type"])
+		assert.EqualValues(10, got["start"])
+		assert.EqualValues(20, got["duration"])
+		assert.EqualValues(1, got["span_id"])
+		assert.EqualValues(2, got["trace_id"])
+		assert.EqualValues(3, got["parent_id"])
+		assert.EqualValues(1, got["error"])
+		assert.Equal("value", got["meta"].(map[string]interface{})["key"])
+		assert.Equal("test error", got["meta"].(map[string]interface{})[ext.ErrorMsg])
+		assert.EqualValues(1.5, got["metrics"].(map[string]interface{})["num"])
+	})
+
+	t.Run("zero", func(t *testing.T) {
+		bs, err := json.Marshal(&span{})
+		assert.NoError(t, err)
+		assert.Equal(t, `{"name":"","service":"","resource":"","type":"","start":0,"duration":0,"span_id":0,"trace_id":0,"parent_id":0,"error":0}`, string(bs))
+	})
+}
+
 const (
 	intUpperLimit = int64(1) << 53
 	intLowerLimit = -intUpperLimit
@@ -447,6 +1052,13 @@ func TestSpanSetMetric(t *testing.T) {
 			assert.Equal(0.0, span.Metrics["bytes"])
 			assert.Equal(fmt.Sprint(intLowerLimit), span.Meta["bytes"])
 		},
+		"nan": func(assert *assert.Assertions, span *span) {
+			span.SetTag("ratio", math.NaN())
+			span.SetTag("+inf", math.Inf(1))
+			span.SetTag("-inf", float32(math.Inf(-1)))
+			assert.Equal(3, len(span.Metrics))
+			assert.NotContains(span.Meta, "ratio")
+		},
 		"finished": func(assert *assert.Assertions, span *span) {
 			span.Finish()
 			span.SetTag("finished.test", 1337)
@@ -693,6 +1305,22 @@ func TestSpanLog(t *testing.T) {
 	})
 }
 
+func TestLogFields(t *testing.T) {
+	assert := assert.New(t)
+	tracer, _, _, stop := startTestTracer(t, WithService("tracer.test"), WithEnv("testenv"))
+	defer stop()
+	sp := tracer.StartSpan("test.request").(*span)
+	assert.Equal(map[string]string{
+		"dd.trace_id": strconv.FormatUint(sp.TraceID, 10),
+		"dd.span_id":  strconv.FormatUint(sp.SpanID, 10),
+		"dd.service":  "tracer.test",
+		"dd.env":      "testenv",
+	}, LogFields(sp))
+
+	assert.Nil(LogFields(nil))
+	assert.Nil(LogFields(internal.NoopSpan{}))
+}
+
 func BenchmarkSetTagMetric(b *testing.B) {
 	span := newBasicSpan("bench.span")
 	keys := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
@@ -11,6 +11,7 @@ import (
 	"sync/atomic"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/internal"
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/samplernames"
@@ -25,9 +26,10 @@ var _ ddtrace.SpanContext = (*spanContext)(nil)
 type spanContext struct {
 	// the below group should propagate only locally
 
-	trace  *trace // reference to the trace that this span belongs too
-	span   *span  // reference to the span that hosts this context
-	errors int32  // number of spans with errors in this trace
+	trace     *trace // reference to the trace that this span belongs too
+	span      *span  // reference to the span that hosts this context; guarded by mu, nil once the span was recycled
+	errors    int32  // number of spans with errors in this trace
+	untracked bool   // the span was truncated from its trace and will not be sent
 
 	// the below group should propagate cross-process
 
@@ -68,10 +70,37 @@ func newSpanContext(span *span, parent *spanContext) *spanContext {
 		context.trace.root = span
 	}
 	// put span in context's trace
-	context.trace.push(span)
+	context.untracked = !context.trace.push(span)
 	return context
 }
 
+// detached returns a copy of the context which holds no reference to its span or
+// trace. It keeps the IDs, sampling priority, propagating tags, origin and baggage,
+// which is all a descendant span needs.
+func (c *spanContext) detached() *spanContext {
+	d := &spanContext{
+		traceID: c.traceID,
+		spanID:  c.spanID,
+		origin:  c.origin,
+		trace:   newTrace(),
+	}
+	if c.trace != nil {
+		c.trace.mu.RLock()
+		for k, v := range c.trace.propagatingTags {
+			d.trace.setPropagatingTagLocked(k, v)
+		}
+		if p, ok := c.trace.samplingPriorityLocked(); ok {
+			d.trace.setSamplingPriorityLocked(p, samplernames.Unknown)
+		}
+		c.trace.mu.RUnlock()
+	}
+	c.ForeachBaggageItem(func(k, v string) bool {
+		d.setBaggageItem(k, v)
+		return true
+	})
+	return d
+}
+
 // SpanID implements ddtrace.SpanContext.
 func (c *spanContext) SpanID() uint64 { return c.spanID }
 
@@ -126,14 +155,33 @@ func (c *spanContext) baggageItem(key string) string {
 }
 
 func (c *spanContext) meta(key string) (val string, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.span == nil {
+		return "", false
+	}
 	c.span.RLock()
 	defer c.span.RUnlock()
 	val, ok = c.span.Meta[key]
 	return val, ok
 }
 
-// finish marks this span as finished in the trace.
-func (c *spanContext) finish() { c.trace.finishedOne(c.span) }
+// local reports whether c is hosted by a span of this process which was not
+// recycled (see WithSpanPooling).
+func (c *spanContext) local() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.span != nil
+}
+
+// finish marks this span as finished in the trace, returning the trace to push
+// to the tracer when it is complete, see finishedOne.
+func (c *spanContext) finish() (*tracer, *finishedTrace) {
+	if c.untracked {
+		return nil, nil
+	}
+	return c.trace.finishedOne(c.span)
+}
 
 // samplingDecision is the decision to send a trace to the agent or not.
 type samplingDecision uint32
@@ -158,9 +206,11 @@ type trace struct {
 	propagatingTags  map[string]string // trace level tags that will be propagated across service boundaries
 	finished         int               // the number of finished spans
 	full             bool              // signifies that the span buffer is full
+	truncated        bool              // signifies that spans over the configured limit were discarded
 	priority         *float64          // sampling priority
 	locked           bool              // specifies if the sampling priority can be altered
 	samplingDecision samplingDecision  // samplingDecision indicates whether to send the trace to the agent.
+	ignored          bool              // the resource of the root matched SetIgnoreResources; the trace is dropped
 
 	// root specifies the root of the trace, if known; it is nil when a span
 	// context is extracted from a carrier, at which point there are no spans in
@@ -188,6 +238,20 @@ func newTrace() *trace {
 	return &trace{spans: make([]*span, 0, traceStartSize)}
 }
 
+// ignore marks the trace to be dropped instead of being sent.
+func (t *trace) ignore() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ignored = true
+}
+
+// isIgnored reports whether the trace was marked to be dropped.
+func (t *trace) isIgnored() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.ignored
+}
+
 func (t *trace) samplingPriorityLocked() (p int, ok bool) {
 	if t.priority == nil {
 		return 0, false
@@ -215,6 +279,42 @@ func (t *trace) drop() {
 	atomic.CompareAndSwapUint32((*uint32)(&t.samplingDecision), uint32(decisionNone), uint32(decisionDrop))
 }
 
+// keepErrored ensures that the trace is sent to the agent with a positive sampling
+// priority, overriding any earlier decision of the samplers to drop it. It is used
+// when a span of the trace finishes with an error. Traces which the user chose to
+// drop, such as using ext.ManualDrop, are left dropped.
+func (t *trace) keepErrored() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.samplingPriorityLocked()
+	if ok && p == ext.PriorityUserReject {
+		return
+	}
+	if !ok || p == ext.PriorityAutoReject {
+		// neither the user nor a sampler kept the trace: record no decision maker
+		t.setSamplingPriorityLocked(ext.PriorityUserKeep, samplernames.Unknown)
+	}
+	atomic.StoreUint32((*uint32)(&t.samplingDecision), uint32(decisionKeep))
+}
+
+// descendants returns the spans of the trace which descend from s, children before
+// their own descendants.
+func (t *trace) descendants(s *span) []*span {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ancestors := map[uint64]struct{}{s.SpanID: {}}
+	var desc []*span
+	for _, sp := range t.spans {
+		// spans are pushed after their parent
+		if _, ok := ancestors[sp.ParentID]; !ok || sp == s {
+			continue
+		}
+		ancestors[sp.SpanID] = struct{}{}
+		desc = append(desc, sp)
+	}
+	return desc
+}
+
 func (t *trace) setTag(key, value string) {
 	if t.tags == nil {
 		t.tags = make(map[string]string, 1)
@@ -265,14 +365,25 @@ func (t *trace) setSamplingPriorityLocked(p int, sampler samplernames.SamplerNam
 }
 
 // push pushes a new span into the trace. If the buffer is full, it returns
-// a errBufferFull error.
-func (t *trace) push(sp *span) {
+// a errBufferFull error. It reports whether the span is tracked by the trace;
+// spans exceeding the limit set using WithMaxSpansPerTrace are not.
+func (t *trace) push(sp *span) bool {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	if t.full {
-		return
+		return true
 	}
 	tr, haveTracer := internal.GetGlobalTracer().(*tracer)
+	if haveTracer && t.root != sp {
+		if n := tr.config.maxSpansPerTrace; n > 0 && len(t.spans) >= n {
+			if !t.truncated {
+				t.truncated = true
+				t.setTag(keySpansTruncated, "true")
+				log.Error("trace %d reached the limit of %d spans, discarding further spans", sp.TraceID, n)
+			}
+			return false
+		}
+	}
 	if len(t.spans) >= traceMaxSize {
 		// capacity is reached, we will not be able to complete this trace.
 		t.full = true
@@ -281,7 +392,7 @@ func (t *trace) push(sp *span) {
 		if haveTracer {
 			atomic.AddUint32(&tr.tracesDropped, 1)
 		}
-		return
+		return true
 	}
 	if v, ok := sp.Metrics[keySamplingPriority]; ok {
 		t.setSamplingPriorityLocked(int(v), samplernames.Unknown)
@@ -290,12 +401,14 @@ func (t *trace) push(sp *span) {
 	if haveTracer {
 		atomic.AddUint32(&tr.spansStarted, 1)
 	}
+	return true
 }
 
 // finishedOne acknowledges that another span in the trace has finished, and checks
-// if the trace is complete, in which case it calls the onFinish function. It uses
-// the given priority, if non-nil, to mark the root span.
-func (t *trace) finishedOne(s *span) {
+// if the trace is complete, in which case it returns the tracer to push it to and
+// the trace to push. It uses the given priority, if non-nil, to mark the root span.
+// s must be locked; the trace must only be pushed once s is unlocked.
+func (t *trace) finishedOne(s *span) (*tracer, *finishedTrace) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	if t.full {
@@ -303,7 +416,7 @@ func (t *trace) finishedOne(s *span) {
 		// all the spans in the trace, so the below conditions will not
 		// be accurate and would trigger a pre-mature flush, exposing us
 		// to a race condition where spans can be modified while flushing.
-		return
+		return nil, nil
 	}
 	t.finished++
 	if s == t.root && t.priority != nil {
@@ -327,20 +440,35 @@ func (t *trace) finishedOne(s *span) {
 		}
 	}
 	if len(t.spans) != t.finished {
-		return
+		return nil, nil
 	}
 	defer func() {
 		t.spans = nil
 		t.finished = 0 // important, because a buffer can be used for several flushes
 	}()
 	tr, ok := internal.GetGlobalTracer().(*tracer)
-	if !ok {
-		return
+	if !ok || tr.stopped() {
+		// the span outlived its tracer; say so rather than losing it silently,
+		// aggregating the reports as every span finishing late triggers one
+		log.Error("span %q finished after the tracer was stopped, dropping its trace of %d span(s)", s.Name, len(t.spans))
+		return nil, nil
 	}
 	// we have a tracer that can receive completed traces.
 	atomic.AddUint32(&tr.spansFinished, uint32(len(t.spans)))
-	tr.pushTrace(&finishedTrace{
+	if t.root != nil && tr.serviceDisabled(t.root.Service) {
+		atomic.AddUint32(&tr.spansServiceDisabled, uint32(len(t.spans)))
+		return nil, nil
+	}
+	if t.ignored {
+		atomic.AddUint32(&tr.tracesIgnored, 1)
+		return nil, nil
+	}
+	ft := &finishedTrace{
 		spans:    t.spans,
 		decision: samplingDecision(atomic.LoadUint32((*uint32)(&t.samplingDecision))),
-	})
+	}
+	if t.priority != nil {
+		ft.priority = int(*t.priority)
+	}
+	return tr, ft
 }
@@ -12,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/samplernames"
@@ -166,6 +167,38 @@ func TestSpanTracePushNoFinish(t *testing.T) {
 	t.Logf("expected timeout, nothing should show up in buffer as the trace is not finished")
 }
 
+func TestSpanFinishAfterStop(t *testing.T) {
+	for name, stopped := range map[string]func(*tracer, func()){
+		// the global tracer was replaced by a no-op one
+		"global": func(_ *tracer, stop func()) { stop() },
+		// the tracer is still the global one, but it was stopped
+		"stopped": func(trc *tracer, _ func()) { trc.Stop() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			tp := new(log.RecordLogger)
+			defer log.UseLogger(tp)()
+			trc, transport, _, stop := startTestTracer(t)
+			defer stop()
+			root := trc.StartSpan("web.request")
+			other := trc.StartSpan("web.request")
+			stopped(trc, stop)
+
+			assert.NotPanics(t, func() { root.Finish() })
+			other.Finish()
+			assert.Equal(t, 0, transport.Len())
+			log.Flush()
+			var found int
+			for _, l := range tp.Logs() {
+				if strings.Contains(l, `span "web.request" finished after the tracer was stopped`) {
+					found++
+				}
+			}
+			// the reports are aggregated
+			assert.Equal(t, 1, found, "expected one warning in %q", tp.Logs())
+		})
+	}
+}
+
 func TestSpanTracePushSeveral(t *testing.T) {
 	defer setupteardown(2, 5)()
 
@@ -374,6 +407,58 @@ func TestSpanContextPushFull(t *testing.T) {
 	assert.Contains(removeAppSec(tp.Lines())[0], "ERROR: trace buffer full (2)")
 }
 
+func TestSpanContextMaxSpansPerTrace(t *testing.T) {
+	assert := assert.New(t)
+	tp := new(log.RecordLogger)
+	defer log.UseLogger(tp)()
+	tracer, transport, flush, stop := startTestTracer(t, WithMaxSpansPerTrace(3))
+	defer stop()
+
+	root := tracer.StartSpan("root")
+	var children []ddtrace.Span
+	for i := 0; i < 5; i++ {
+		children = append(children, tracer.StartSpan("child", ChildOf(root.Context())))
+	}
+	assert.False(children[1].Context().(*spanContext).untracked)
+	assert.True(children[2].Context().(*spanContext).untracked)
+	for _, child := range children {
+		child.Finish()
+	}
+	root.Finish()
+	flush(1)
+
+	traces := transport.Traces()
+	assert.Len(traces, 1)
+	assert.Len(traces[0], 3)
+	assert.Equal("true", traces[0][0].Meta[keySpansTruncated])
+
+	// the limit applies to each trace separately
+	root = tracer.StartSpan("root")
+	tracer.StartSpan("child", ChildOf(root.Context())).Finish()
+	root.Finish()
+	flush(1)
+	traces = transport.Traces()
+	assert.Len(traces, 1)
+	assert.Len(traces[0], 2)
+	assert.NotContains(traces[0][0].Meta, keySpansTruncated)
+
+	// the reports of truncated traces are aggregated
+	root = tracer.StartSpan("root")
+	for i := 0; i < 5; i++ {
+		tracer.StartSpan("child", ChildOf(root.Context())).Finish()
+	}
+	root.Finish()
+	flush(1)
+	log.Flush()
+	var found int
+	for _, l := range tp.Logs() {
+		if strings.Contains(l, "reached the limit of 3 spans") {
+			found++
+		}
+	}
+	assert.Equal(1, found, "expected one warning in %q", tp.Logs())
+}
+
 func TestSpanContextBaggage(t *testing.T) {
 	assert := assert.New(t)
 
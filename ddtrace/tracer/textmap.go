@@ -11,6 +11,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
@@ -190,6 +191,8 @@ func getPropagators(cfg *PropagatorConfig, env string) []Propagator {
 				// propagatorB3 hasn't already been added, add a new one.
 				list = append(list, &propagatorB3{})
 			}
+		case "xray":
+			list = append(list, &propagatorXRay{})
 		default:
 			log.Warn("unrecognized propagator: %s\n", v)
 		}
@@ -456,3 +459,145 @@ func (*propagatorB3) extractTextMap(reader TextMapReader) (ddtrace.SpanContext,
 	}
 	return &ctx, nil
 }
+
+// xrayHeader specifies the name of the AWS X-Ray trace header.
+// See https://docs.aws.amazon.com/xray/latest/devguide/xray-concepts.html#xray-concepts-tracingheader
+const xrayHeader = "x-amzn-trace-id"
+
+// propagatorXRay implements Propagator and injects/extracts span contexts
+// using the AWS X-Ray trace header. Only TextMap carriers are supported.
+//
+// X-Ray trace IDs consist of a version, the epoch time at which the trace
+// started and 96 random bits, such as 1-5759e988-bd862e3fe1be46a994272793.
+// The lower 64 bits are used as the trace ID when extracting, while the epoch
+// and the upper 32 bits are kept as the _dd.p.xray_root propagating tag, so
+// that the same X-Ray trace ID is injected downstream. Traces started locally
+// are injected using the start time of their root and zero upper bits.
+type propagatorXRay struct{}
+
+// keyXRayRoot is the propagating tag holding the epoch and upper 32 bits of an
+// extracted X-Ray trace ID, as "5759e988-bd862e3f".
+const keyXRayRoot = "_dd.p.xray_root"
+
+// xrayRootPrefix returns the part of an X-Ray trace ID preceding its lower 64 bits,
+// such as "5759e988-bd862e3f", kept in the _dd.p.xray_root tag v. It reports false
+// when v is malformed.
+func xrayRootPrefix(v string) (string, bool) {
+	parts := strings.Split(v, "-")
+	if len(parts) != 2 || len(parts[0]) != 8 || len(parts[1]) != 8 {
+		return "", false
+	}
+	for _, p := range parts {
+		if _, err := strconv.ParseUint(p, 16, 32); err != nil {
+			return "", false
+		}
+	}
+	return v, true
+}
+
+func (p *propagatorXRay) Inject(spanCtx ddtrace.SpanContext, carrier interface{}) error {
+	switch c := carrier.(type) {
+	case TextMapWriter:
+		return p.injectTextMap(spanCtx, c)
+	default:
+		return ErrInvalidCarrier
+	}
+}
+
+func (*propagatorXRay) injectTextMap(spanCtx ddtrace.SpanContext, writer TextMapWriter) error {
+	ctx, ok := spanCtx.(*spanContext)
+	if !ok || ctx.traceID == 0 || ctx.spanID == 0 {
+		return ErrInvalidSpanContext
+	}
+	start := time.Now()
+	var prefix string
+	if ctx.trace != nil {
+		ctx.trace.mu.RLock()
+		if root := ctx.trace.root; root != nil && root.Start > 0 {
+			start = time.Unix(0, root.Start)
+		}
+		prefix, _ = xrayRootPrefix(ctx.trace.propagatingTags[keyXRayRoot])
+		ctx.trace.mu.RUnlock()
+	}
+	if prefix == "" {
+		// the trace was not continued from X-Ray
+		prefix = fmt.Sprintf("%08x-00000000", start.Unix())
+	}
+	v := fmt.Sprintf("Root=1-%s%016x;Parent=%016x", prefix, ctx.traceID, ctx.spanID)
+	if p, ok := ctx.samplingPriority(); ok {
+		if p >= ext.PriorityAutoKeep {
+			v += ";Sampled=1"
+		} else {
+			v += ";Sampled=0"
+		}
+	}
+	writer.Set(xrayHeader, v)
+	return nil
+}
+
+func (p *propagatorXRay) Extract(carrier interface{}) (ddtrace.SpanContext, error) {
+	switch c := carrier.(type) {
+	case TextMapReader:
+		return p.extractTextMap(c)
+	default:
+		return nil, ErrInvalidCarrier
+	}
+}
+
+func (*propagatorXRay) extractTextMap(reader TextMapReader) (ddtrace.SpanContext, error) {
+	var ctx spanContext
+	err := reader.ForeachKey(func(k, v string) error {
+		if strings.ToLower(k) != xrayHeader {
+			return nil
+		}
+		for _, field := range strings.Split(v, ";") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			var err error
+			switch kv[0] {
+			case "Root":
+				// 1-5759e988-bd862e3fe1be46a994272793
+				parts := strings.Split(kv[1], "-")
+				if len(parts) != 3 || len(parts[2]) != 24 {
+					return ErrSpanContextCorrupted
+				}
+				ctx.traceID, err = strconv.ParseUint(parts[2][8:], 16, 64)
+				if err != nil {
+					return ErrSpanContextCorrupted
+				}
+				prefix, ok := xrayRootPrefix(parts[1] + "-" + parts[2][:8])
+				if !ok {
+					return ErrSpanContextCorrupted
+				}
+				if ctx.trace == nil {
+					ctx.trace = newTrace()
+				}
+				ctx.trace.setPropagatingTag(keyXRayRoot, prefix)
+			case "Parent":
+				ctx.spanID, err = strconv.ParseUint(kv[1], 16, 64)
+				if err != nil {
+					return ErrSpanContextCorrupted
+				}
+			case "Sampled":
+				switch kv[1] {
+				case "1":
+					ctx.setSamplingPriority(ext.PriorityAutoKeep, samplernames.Unknown)
+				case "0":
+					ctx.setSamplingPriority(ext.PriorityAutoReject, samplernames.Unknown)
+				default:
+					// "?" lets the local sampler decide
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ctx.traceID == 0 || ctx.spanID == 0 {
+		return nil, ErrSpanContextNotFound
+	}
+	return &ctx, nil
+}
@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/internal"
@@ -181,6 +182,38 @@ func TestTextMapPropagatorOrigin(t *testing.T) {
 	}
 }
 
+func TestTextMapPropagatorNoOrigin(t *testing.T) {
+	for name, src := range map[string]TextMapCarrier{
+		"empty": {
+			originHeader:          "",
+			DefaultTraceIDHeader:  "1",
+			DefaultParentIDHeader: "1",
+		},
+		"missing": {
+			DefaultTraceIDHeader:  "1",
+			DefaultParentIDHeader: "1",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			tracer := newTracer()
+			defer tracer.Stop()
+			ctx, err := tracer.Extract(src)
+			assert.Nil(err)
+			assert.Empty(ctx.(*spanContext).origin)
+
+			root := tracer.StartSpan("root", ChildOf(ctx))
+			child := tracer.StartSpan("child", ChildOf(root.Context()))
+			assert.NotContains(root.(*span).Meta, keyOrigin)
+			assert.NotContains(child.(*span).Meta, keyOrigin)
+
+			dst := map[string]string{}
+			assert.Nil(tracer.Inject(child.Context(), TextMapCarrier(dst)))
+			assert.NotContains(dst, originHeader)
+		})
+	}
+}
+
 func TestTextMapPropagatorTraceTagsWithPriority(t *testing.T) {
 	src := TextMapCarrier(map[string]string{
 		DefaultPriorityHeader: "1",
@@ -549,6 +582,100 @@ func TestB3(t *testing.T) {
 	})
 }
 
+func TestXRay(t *testing.T) {
+	t.Run("inject", func(t *testing.T) {
+		os.Setenv("DD_PROPAGATION_STYLE_INJECT", "xray")
+		defer os.Unsetenv("DD_PROPAGATION_STYLE_INJECT")
+
+		tracer := newTracer()
+		defer tracer.Stop()
+		root := tracer.StartSpan("web.request", StartTime(time.Unix(1465510280, 0))).(*span)
+		root.SetTag(ext.SamplingPriority, ext.PriorityUserKeep)
+		ctx := root.Context().(*spanContext)
+		ctx.traceID = 1412508178991881
+		ctx.spanID = 1842642739201064
+		headers := TextMapCarrier(map[string]string{})
+
+		assert := assert.New(t)
+		assert.Nil(tracer.Inject(ctx, headers))
+		assert.Equal("Root=1-5759e988-00000000000504ab30404b09;Parent=00068bdfb1eb0428;Sampled=1", headers[xrayHeader])
+		assert.NotContains(headers, DefaultTraceIDHeader)
+	})
+
+	t.Run("extract", func(t *testing.T) {
+		os.Setenv("DD_PROPAGATION_STYLE_EXTRACT", "xray")
+		defer os.Unsetenv("DD_PROPAGATION_STYLE_EXTRACT")
+
+		var tests = []struct {
+			in       string
+			out      []uint64 // contains [<trace_id>, <span_id>]
+			priority int
+			sampled  bool // whether a sampling decision was extracted
+		}{
+			{"Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1", []uint64{0xe1be46a994272793, 0x53995c3f42cd8ad8}, ext.PriorityAutoKeep, true},
+			{"Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=0", []uint64{0xe1be46a994272793, 0x53995c3f42cd8ad8}, ext.PriorityAutoReject, true},
+			{"Root=1-5759e988-bd862e3fe1be46a994272793; Parent=53995c3f42cd8ad8; Sampled=?", []uint64{0xe1be46a994272793, 0x53995c3f42cd8ad8}, 0, false},
+			{"Self=1-5759e988-00000000000000000000000a;Root=1-5759e988-00000000000504ab30404b09;Parent=00068bdfb1eb0428", []uint64{1412508178991881, 1842642739201064}, 0, false},
+		}
+		for _, test := range tests {
+			t.Run("", func(t *testing.T) {
+				tracer := newTracer()
+				defer tracer.Stop()
+				assert := assert.New(t)
+				ctx, err := tracer.Extract(TextMapCarrier{"X-Amzn-Trace-Id": test.in})
+				assert.Nil(err)
+				sctx, ok := ctx.(*spanContext)
+				assert.True(ok)
+				assert.Equal(test.out[0], sctx.traceID)
+				assert.Equal(test.out[1], sctx.spanID)
+				p, ok := sctx.samplingPriority()
+				assert.Equal(test.sampled, ok)
+				assert.Equal(test.priority, p)
+			})
+		}
+	})
+
+	t.Run("round-trip", func(t *testing.T) {
+		os.Setenv("DD_PROPAGATION_STYLE_INJECT", "xray")
+		defer os.Unsetenv("DD_PROPAGATION_STYLE_INJECT")
+		os.Setenv("DD_PROPAGATION_STYLE_EXTRACT", "xray")
+		defer os.Unsetenv("DD_PROPAGATION_STYLE_EXTRACT")
+
+		assert := assert.New(t)
+		tracer := newTracer()
+		defer tracer.Stop()
+		in := "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"
+		ctx, err := tracer.Extract(TextMapCarrier{xrayHeader: in})
+		assert.Nil(err)
+		headers := TextMapCarrier(map[string]string{})
+		assert.Nil(tracer.Inject(ctx, headers))
+		assert.Equal(in, headers[xrayHeader])
+
+		// the X-Ray trace ID is kept by the spans continuing the trace
+		child := tracer.StartSpan("web.request", ChildOf(ctx))
+		headers = TextMapCarrier(map[string]string{})
+		assert.Nil(tracer.Inject(child.Context(), headers))
+		assert.Equal(fmt.Sprintf("Root=1-5759e988-bd862e3fe1be46a994272793;Parent=%016x;Sampled=1", child.Context().SpanID()), headers[xrayHeader])
+	})
+
+	t.Run("extract/errors", func(t *testing.T) {
+		os.Setenv("DD_PROPAGATION_STYLE_EXTRACT", "xray")
+		defer os.Unsetenv("DD_PROPAGATION_STYLE_EXTRACT")
+
+		tracer := newTracer()
+		defer tracer.Stop()
+		for in, want := range map[string]error{
+			"Root=1-5759e988-bd862e3fe1be46a994272793":                 ErrSpanContextNotFound,
+			"Root=1-5759e988-bd862e3f;Parent=53995c3f42cd8ad8":         ErrSpanContextCorrupted,
+			"Root=1-5759e988-bd862e3fe1be46a99427279z;Parent=53995c3f": ErrSpanContextCorrupted,
+			"Root=1-5759e988-bd862e3fe1be46a994272793;Parent=xyz":      ErrSpanContextCorrupted,
+		} {
+			_, err := tracer.Extract(TextMapCarrier{xrayHeader: in})
+			assert.Equal(t, want, err, in)
+		}
+	})
+}
+
 func assertTraceTags(t *testing.T, expected, actual string) {
 	assert.ElementsMatch(t, strings.Split(expected, ","), strings.Split(actual, ","))
 }
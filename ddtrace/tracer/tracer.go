@@ -7,10 +7,15 @@ package tracer
 
 import (
 	gocontext "context"
+	"fmt"
 	"os"
+	"reflect"
+	"regexp"
+	"runtime"
 	"runtime/pprof"
 	rt "runtime/trace"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,6 +26,7 @@ import (
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/appsec"
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/traceprof"
+	"gopkg.in/DataDog/dd-trace-go.v1/internal/version"
 
 	"github.com/DataDog/datadog-agent/pkg/obfuscate"
 )
@@ -53,6 +59,14 @@ type tracer struct {
 	// triggered and completed.
 	flush chan chan<- struct{}
 
+	// snapshot receives a channel onto which the worker sends the traces
+	// buffered in the payload being filled, see Snapshot.
+	snapshot chan chan<- [][]SpanSnapshot
+
+	// manualMu serializes flushes when the tracer runs without a worker (see
+	// WithoutWorker), in which case they are done by the caller's goroutine.
+	manualMu sync.Mutex
+
 	// stop causes the tracer to shut down when closed.
 	stop chan struct{}
 
@@ -68,16 +82,58 @@ type tracer struct {
 	// pid of the process
 	pid string
 
+	// health caches the result of checking the agent's reachability; see Healthy.
+	health healthChecker
+
 	// These integers track metrics about spans and traces as they are started,
 	// finished, and dropped
 	spansStarted, spansFinished, tracesDropped uint32
 
+	// tracesQueueFull records the number of traces dropped because the payload
+	// queue was full.
+	tracesQueueFull uint32
+
+	// overflowMu serializes evictions from the payload queue when it is full.
+	overflowMu sync.Mutex
+
+	// spansBuffered holds the number of spans which are queued, buffered in a
+	// payload or being sent. It is only maintained when WithMaxBufferedSpans is used.
+	spansBuffered int64
+
+	// maxQueued records the largest length of the payload queue since the last
+	// call to ReadFlushStats.
+	maxQueued int64
+
+	// tracesShed records the number of traces dropped because the limit set using
+	// WithMaxBufferedSpans was reached.
+	tracesShed uint32
+
 	// Records the number of dropped P0 traces and spans.
 	droppedP0Traces, droppedP0Spans uint32
 
 	// partialTrace the number of partially dropped traces.
 	partialTraces uint32
 
+	// spansFiltered records the number of spans dropped by the span filter.
+	spansFiltered uint32
+
+	// tracesIgnored records the number of traces dropped because the resource of
+	// their root matched a pattern set using SetIgnoreResources.
+	tracesIgnored uint32
+
+	// ignoredResources holds the []*regexp.Regexp set using SetIgnoreResources.
+	ignoredResources atomic.Value
+
+	// spansServiceDisabled records the number of spans dropped because the
+	// service of their trace was disabled using SetServiceEnabled.
+	spansServiceDisabled uint32
+
+	// disabledServices holds the set of services disabled using SetServiceEnabled,
+	// as a map[string]struct{}. It is replaced rather than modified, under
+	// disabledServicesMu, so that it can be read without locking.
+	disabledServices   atomic.Value
+	disabledServicesMu sync.Mutex
+
 	// rulesSampling holds an instance of the rules sampler used to apply either trace sampling,
 	// or single span sampling rules on spans. These are user-defined
 	// rules for applying a sampling rate to spans that match the designated service
@@ -105,8 +161,17 @@ const (
 	// concurrentConnectionLimit specifies the maximum number of concurrent outgoing
 	// connections allowed.
 	concurrentConnectionLimit = 100
+
+	// sendTimeout bounds the time spent sending a single payload, regardless of the
+	// timeout of the HTTP client in use, so that a hung agent can not hold on to the
+	// connections allowed by concurrentConnectionLimit indefinitely.
+	sendTimeout = 5 * flushInterval
 )
 
+// Version is the version of this tracer, which is also set on the local root
+// span of every trace as the _dd.tracer_version tag.
+const Version = version.Tag
+
 // statsInterval is the interval at which health metrics will be sent with the
 // statsd client; replaced in tests.
 var statsInterval = 10 * time.Second
@@ -145,6 +210,39 @@ func StartSpan(operationName string, opts ...StartSpanOption) Span {
 	return internal.GetGlobalTracer().StartSpan(operationName, opts...)
 }
 
+// StartChild starts a new span with the given operation name as a child of parent,
+// inheriting its service and sampling decision. It is equivalent to calling StartSpan
+// using the ChildOf option, without having to reference the parent's context. An
+// inert span is returned when parent is nil or inert itself.
+func StartChild(parent Span, operationName string, opts ...StartSpanOption) Span {
+	if parent == nil {
+		return internal.NoopSpan{}
+	}
+	if _, ok := parent.(internal.NoopSpan); ok {
+		return internal.NoopSpan{}
+	}
+	opts = append(opts[:len(opts):len(opts)], ChildOf(parent.Context()))
+	return StartSpan(operationName, opts...)
+}
+
+// StartSpanFromTextMap starts a span continuing the trace whose context was
+// propagated in carrier, such as the attributes of a message received from a queue,
+// using the configured propagators. The trace ID, sampling priority, origin and
+// baggage are taken from the carrier, and the span becomes a child of the span which
+// injected them. When the carrier holds no valid trace context, a new trace is
+// started instead.
+func StartSpanFromTextMap(operationName string, carrier map[string]string, opts ...StartSpanOption) Span {
+	sctx, err := Extract(TextMapCarrier(carrier))
+	if err != nil {
+		if err != ErrSpanContextNotFound {
+			log.Debug("Failed to extract the span context from the text map, starting a new trace: %v", err)
+		}
+		return StartSpan(operationName, opts...)
+	}
+	opts = append(opts[:len(opts):len(opts)], ChildOf(sctx))
+	return StartSpan(operationName, opts...)
+}
+
 // Extract extracts a SpanContext from the carrier. The carrier is expected
 // to implement TextMapReader, otherwise an error is returned.
 // If the tracer is not started, calling this function is a no-op.
@@ -180,7 +278,192 @@ func SetUser(s Span, id string, opts ...UserMonitoringOption) {
 	sp.setUser(id, cfg)
 }
 
-// payloadQueueSize is the buffer size of the trace channel.
+// SetTags sets all the given tags on the span. It is equivalent to calling SetTag
+// for each of them, but cheaper when setting many tags at once. It has no effect
+// on spans which have finished.
+func SetTags(s Span, tags map[string]string) {
+	if s == nil {
+		return
+	}
+	if sp, ok := s.(*span); ok {
+		sp.setTags(tags)
+		return
+	}
+	for k, v := range tags {
+		s.SetTag(k, v)
+	}
+}
+
+// SetStructTags sets the exported fields of the struct v, or of the struct v points
+// to, as tags on the span, named after the fields and prefixed by prefix followed by
+// a dot when prefix is not empty. Numeric fields are set as metrics, while strings,
+// booleans and structs implementing fmt.Stringer are set as meta. The fields of
+// nested structs are flattened one level deep, and nil pointers are followed no
+// further. Fields of other kinds, such as slices, maps, channels and functions,
+// are skipped, as are fields holding their zero value.
+//
+// A field's tag name can be set using the "trace" struct tag, and "-" skips the
+// field. The "keepzero" option sets the field even when it holds its zero value:
+//
+//	type request struct {
+//		User    string `trace:"user.id"`
+//		Retries int    `trace:"retries,keepzero"`
+//		Token   string `trace:"-"`
+//	}
+//
+// SetStructTags relies on reflection and is considerably slower than calling
+// SetTag for each field, so it should be avoided on hot paths.
+func SetStructTags(s Span, v interface{}, prefix string) {
+	if s == nil || v == nil {
+		return
+	}
+	setStructTags(s, reflect.ValueOf(v), prefix, 1)
+}
+
+// SetMeasured marks the given span as measured, or not, after it was started, as the
+// Measured option does when starting it. Trace metrics, such as hits and latency, are
+// computed for measured spans in addition to the top level spans, which are the root
+// of a trace and the spans whose service differs from their parent's. Top level spans
+// are always measured, so marking them has no effect, while other spans are not
+// measured by default. Marking a span measured makes it possible to get metrics for
+// an operation deep in a trace, such as a database query. It has no effect on spans
+// which have finished.
+func SetMeasured(s Span, measured bool) {
+	if s == nil {
+		return
+	}
+	sp, ok := s.(*span)
+	if !ok {
+		if measured {
+			s.SetTag(keyMeasured, 1)
+		}
+		return
+	}
+	sp.Lock()
+	defer sp.Unlock()
+	if sp.finished {
+		return
+	}
+	if !measured || sp.Metrics[keyTopLevel] == 1 {
+		// top level spans are measured, so the tag is redundant
+		delete(sp.Metrics, keyMeasured)
+		return
+	}
+	sp.setMetric(keyMeasured, 1)
+}
+
+// AddSpanLink links the given span to the span identified by traceID and spanID,
+// optionally describing the relationship using attributes. Unlike a parent, a
+// linked span may be part of a different trace: a span processing a batch of
+// messages can for example be linked to each of the spans which produced them.
+// A span holds up to 128 links, and links can not be added once it finished.
+// Links are only displayed by versions of the Datadog backend supporting them.
+func AddSpanLink(s Span, traceID, spanID uint64, attributes map[string]string) {
+	if s == nil {
+		return
+	}
+	sp, ok := s.(*span)
+	if !ok {
+		return
+	}
+	sp.addLink(SpanLink{TraceID: traceID, SpanID: spanID, Attributes: attributes})
+}
+
+// OnFinish registers fn to be called when the given span finishes, for example to
+// record a metric specific to the operation. fn is called once, synchronously, by the
+// first call to Finish, right before the span is marked finished, so it may still set
+// tags on the span. A panic in fn is recovered and logged. It has no effect on spans
+// which have finished or which were not created by this package.
+func OnFinish(s Span, fn func(Span)) {
+	if sp, ok := s.(*span); ok && fn != nil {
+		sp.addFinishHook(fn)
+	}
+}
+
+// FinishTree finishes the given span along with all of its descendants started in
+// this process which have not finished yet, such as the spans of operations left
+// open when a request is aborted. When err is not nil, it is set as the error of
+// every span finished this way. Descendants which already finished are left
+// untouched. It has no effect on the descendants of spans not created by this
+// package, which are only finished themselves.
+func FinishTree(s Span, err error) {
+	if s == nil {
+		return
+	}
+	var opts []FinishOption
+	if err != nil {
+		opts = append(opts, WithError(err))
+	}
+	if sp, ok := s.(*span); ok && sp.context != nil && sp.context.trace != nil {
+		desc := sp.context.trace.descendants(sp)
+		// finish the deepest spans first; Finish has no effect on finished spans
+		for i := len(desc) - 1; i >= 0; i-- {
+			desc[i].Finish(opts...)
+		}
+	}
+	s.Finish(opts...)
+}
+
+// LogFields returns the fields which correlate a log entry with the given span, to be
+// added to the structured fields of a logger: dd.trace_id and dd.span_id as decimal
+// strings, along with dd.service, dd.env and dd.version when they are set. They match
+// the fields printed when formatting a span using the %v verb. It returns nil when s
+// is nil or does not belong to a trace.
+func LogFields(s Span) map[string]string {
+	if s == nil {
+		return nil
+	}
+	ctx := s.Context()
+	if ctx == nil || ctx.TraceID() == 0 {
+		return nil
+	}
+	fields := map[string]string{
+		// trace IDs are 64-bit, which is what the logs pipeline expects
+		"dd.trace_id": strconv.FormatUint(ctx.TraceID(), 10),
+		"dd.span_id":  strconv.FormatUint(ctx.SpanID(), 10),
+	}
+	svc, env, version := correlationTags()
+	if svc != "" {
+		fields["dd.service"] = svc
+	}
+	if env != "" {
+		fields["dd.env"] = env
+	}
+	if version != "" {
+		fields["dd.version"] = version
+	}
+	return fields
+}
+
+// SpanDuration returns the duration of the given span once it has finished, or the
+// time elapsed since it started otherwise. The start time set using the StartTime
+// option is honored. It returns zero for spans not created by this package.
+func SpanDuration(s Span) time.Duration {
+	sp, ok := s.(*span)
+	if !ok {
+		return 0
+	}
+	sp.RLock()
+	defer sp.RUnlock()
+	if sp.finished {
+		return time.Duration(sp.Duration)
+	}
+	return time.Duration(now() - sp.Start)
+}
+
+// SpanFinished reports whether the given span has finished. It returns false for
+// spans not created by this package.
+func SpanFinished(s Span) bool {
+	sp, ok := s.(*span)
+	if !ok {
+		return false
+	}
+	sp.RLock()
+	defer sp.RUnlock()
+	return sp.finished
+}
+
+// payloadQueueSize is the default buffer size of the trace channel.
 const payloadQueueSize = 1000
 
 func newUnstartedTracer(opts ...StartOption) *tracer {
@@ -202,12 +485,17 @@ func newUnstartedTracer(opts ...StartOption) *tracer {
 	if spans != nil {
 		c.spanRules = spans
 	}
+	queueSize := payloadQueueSize
+	if c.queueSize > 0 {
+		queueSize = c.queueSize
+	}
 	t := &tracer{
 		config:           c,
 		traceWriter:      writer,
-		out:              make(chan *finishedTrace, payloadQueueSize),
+		out:              make(chan *finishedTrace, queueSize),
 		stop:             make(chan struct{}),
 		flush:            make(chan chan<- struct{}),
+		snapshot:         make(chan chan<- [][]SpanSnapshot),
 		rulesSampling:    newRulesSampler(c.traceRules, c.spanRules),
 		prioritySampling: sampler,
 		pid:              strconv.Itoa(os.Getpid()),
@@ -222,6 +510,9 @@ func newUnstartedTracer(opts ...StartOption) *tracer {
 			},
 		}),
 	}
+	if w, ok := writer.(*agentTraceWriter); ok {
+		w.release = t.releaseSpans
+	}
 	return t
 }
 
@@ -237,27 +528,175 @@ func newTracer(opts ...StartOption) *tracer {
 			t.reportRuntimeMetrics(defaultMetricsReportInterval)
 		}()
 	}
-	t.wg.Add(1)
-	go func() {
-		defer t.wg.Done()
-		tick := t.config.tickChan
-		if tick == nil {
-			ticker := time.NewTicker(flushInterval)
-			defer ticker.Stop()
-			tick = ticker.C
-		}
-		t.worker(tick)
-	}()
+	if !c.noWorker {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			tick := t.config.tickChan
+			if tick == nil {
+				ticker := time.NewTicker(flushInterval)
+				defer ticker.Stop()
+				tick = ticker.C
+			}
+			t.worker(tick)
+		}()
+	}
 	t.wg.Add(1)
 	go func() {
 		defer t.wg.Done()
 		t.reportHealthMetrics(statsInterval)
 	}()
+	if w, ok := t.traceWriter.(*agentTraceWriter); ok && c.ratesPollInterval > 0 {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.pollSamplingRates(w, c.ratesPollInterval)
+		}()
+	}
 	t.stats.Start()
 	appsec.Start()
 	return t
 }
 
+// SetServiceEnabled enables or disables tracing for the given service at runtime,
+// without affecting other services. The traces of a disabled service, those whose
+// local root span has that service, are dropped as they finish, and counted by the
+// datadog.tracer.spans_dropped health metric. All services are enabled when the
+// tracer starts, so the setting is lost if the tracer is restarted. It has no
+// effect if the tracer is not started.
+func SetServiceEnabled(service string, enabled bool) {
+	if t, ok := internal.GetGlobalTracer().(*tracer); ok {
+		t.setServiceEnabled(service, enabled)
+	}
+}
+
+// setServiceEnabled implements SetServiceEnabled.
+func (t *tracer) setServiceEnabled(service string, enabled bool) {
+	t.disabledServicesMu.Lock()
+	defer t.disabledServicesMu.Unlock()
+	old, _ := t.disabledServices.Load().(map[string]struct{})
+	if _, disabled := old[service]; disabled == !enabled {
+		// nothing changes
+		return
+	}
+	m := make(map[string]struct{}, len(old)+1)
+	for k := range old {
+		m[k] = struct{}{}
+	}
+	if enabled {
+		delete(m, service)
+	} else {
+		m[service] = struct{}{}
+	}
+	t.disabledServices.Store(m)
+}
+
+// serviceDisabled reports whether the given service was disabled using
+// SetServiceEnabled.
+func (t *tracer) serviceDisabled(service string) bool {
+	m, _ := t.disabledServices.Load().(map[string]struct{})
+	_, ok := m[service]
+	return ok
+}
+
+// tracerPackage is the prefix of the names of the functions of this package.
+var tracerPackage = reflect.TypeOf(tracer{}).PkgPath() + "."
+
+// callerLocation returns the file:line of the first caller outside of this package,
+// which is the code starting a span whether it called StartSpan directly or through
+// helpers such as StartSpanFromContext. Tests of this package count as callers.
+func callerLocation() (string, bool) {
+	var pcs [16]uintptr
+	n := runtime.Callers(2, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, tracerPackage) || strings.HasSuffix(frame.File, "_test.go") {
+			return frame.File + ":" + strconv.Itoa(frame.Line), frame.Function != ""
+		}
+		if !more {
+			return "", false
+		}
+	}
+}
+
+// SetIgnoreResources sets regular expressions matching the resources of the traces
+// which are never sent to the agent, such as health checks. A trace is ignored when
+// the resource its local root span was started with matches any of the patterns;
+// the trace's other spans are dropped with it, and no stats are computed for them.
+// Patterns match anywhere in the resource unless anchored using ^ and $. An error
+// is returned, and the previous patterns are kept, if any pattern is invalid. Calling
+// SetIgnoreResources again replaces the patterns, and an empty list ignores no trace.
+// Ignored traces are counted by the datadog.tracer.traces_dropped health metric.
+// It has no effect if the tracer is not started.
+func SetIgnoreResources(patterns []string) error {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("invalid resource pattern %q: %v", p, err)
+		}
+		res = append(res, re)
+	}
+	if t, ok := internal.GetGlobalTracer().(*tracer); ok {
+		t.ignoredResources.Store(res)
+	}
+	return nil
+}
+
+// resourceIgnored reports whether resource matches a pattern set using
+// SetIgnoreResources.
+func (t *tracer) resourceIgnored(resource string) bool {
+	res, _ := t.ignoredResources.Load().([]*regexp.Regexp)
+	for _, re := range res {
+		if re.MatchString(resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadFlushStats returns statistics about the payloads of traces sent to the agent
+// since the previous call, such as how long sending them took, how many spans they
+// held and how full the queue of finished traces got, to help tune the flush
+// interval and queue size. The statistics are reset on every call, so they should
+// only be read by a single poller to avoid double counting. The zero value is
+// returned when the tracer is not started or when traces are not sent to an agent.
+func ReadFlushStats() FlushStats {
+	return flushStats(true)
+}
+
+// PeekFlushStats returns the same statistics as ReadFlushStats without resetting
+// them, so that they cover every payload sent since the tracer was started or since
+// the last call to ReadFlushStats or ResetFlushStats. Several pollers may use it,
+// leaving resets to at most one of them. All the statistics are read at once, so
+// they are consistent with one another even while payloads are being sent.
+func PeekFlushStats() FlushStats {
+	return flushStats(false)
+}
+
+// ResetFlushStats resets the statistics returned by PeekFlushStats, for pollers
+// which want to compute deltas from a known starting point.
+func ResetFlushStats() {
+	flushStats(true)
+}
+
+// flushStats returns the flush statistics of the global tracer, resetting them
+// when reset is true.
+func flushStats(reset bool) FlushStats {
+	t, ok := internal.GetGlobalTracer().(*tracer)
+	if !ok {
+		return FlushStats{}
+	}
+	w, ok := t.traceWriter.(*agentTraceWriter)
+	if !ok {
+		return FlushStats{}
+	}
+	s := w.flushStats.snapshot(&t.maxQueued, reset)
+	s.BufferedBytes = int(atomic.LoadInt64(&w.bufferedBytes))
+	return s
+}
+
 // Flush flushes any buffered traces. Flush is in effect only if a tracer
 // is started. Users do not have to call Flush in order to ensure that
 // traces reach Datadog. It is a convenience method dedicated to a specific
@@ -267,7 +706,10 @@ func newTracer(opts ...StartOption) *tracer {
 // the tracer on each invokation may create too much latency. In this
 // scenario, a tracer may be started and stopped by the parent process
 // whereas the invokation can make use of Flush to ensure any created spans
-// reach the agent.
+// reach the agent. Flush returns once buffered traces were sent.
+//
+// When the tracer was started using WithoutWorker, Flush is the only way
+// to send traces before the tracer is stopped.
 func Flush() {
 	if t, ok := internal.GetGlobalTracer().(*tracer); ok {
 		t.flushSync()
@@ -276,6 +718,17 @@ func Flush() {
 
 // flushSync triggers a flush and waits for it to complete.
 func (t *tracer) flushSync() {
+	if t.config.noWorker {
+		t.manualMu.Lock()
+		defer t.manualMu.Unlock()
+		t.drainQueue()
+		t.config.statsd.Incr("datadog.tracer.flush_triggered", []string{"reason:invoked"}, 1)
+		t.traceWriter.flush()
+		if w, ok := t.traceWriter.(*agentTraceWriter); ok {
+			w.wg.Wait()
+		}
+		return
+	}
 	done := make(chan struct{})
 	t.flush <- done
 	<-done
@@ -287,37 +740,69 @@ func (t *tracer) worker(tick <-chan time.Time) {
 	for {
 		select {
 		case trace := <-t.out:
-			t.sampleFinishedTrace(trace)
-			if len(trace.spans) != 0 {
-				t.traceWriter.add(trace.spans)
-			}
+			t.addTrace(trace)
 		case <-tick:
 			t.config.statsd.Incr("datadog.tracer.flush_triggered", []string{"reason:scheduled"}, 1)
 			t.traceWriter.flush()
 
 		case done := <-t.flush:
+			// include the traces which finished before Flush was called
+			t.drainQueue()
 			t.config.statsd.Incr("datadog.tracer.flush_triggered", []string{"reason:invoked"}, 1)
 			t.traceWriter.flush()
-			// TODO(x): In reality, the traceWriter.flush() call is not synchronous
-			// when using the agent traceWriter. However, this functionnality is used
-			// in Lambda so for that purpose this mechanism should suffice.
+			if w, ok := t.traceWriter.(*agentTraceWriter); ok {
+				// wait for the payloads to be sent to the agent
+				w.wg.Wait()
+			}
 			done <- struct{}{}
 
+		case res := <-t.snapshot:
+			t.drainQueue()
+			res <- t.bufferedTraces()
+
 		case <-t.stop:
-		loop:
-			// the loop ensures that the payload channel is fully drained
-			// before the final flush to ensure no traces are lost (see #526)
-			for {
-				select {
-				case trace := <-t.out:
-					t.sampleFinishedTrace(trace)
-					if len(trace.spans) != 0 {
-						t.traceWriter.add(trace.spans)
-					}
-				default:
-					break loop
-				}
-			}
+			// the payload channel is fully drained before the final flush
+			// to ensure no traces are lost (see #526)
+			t.drainQueue()
+			return
+		}
+	}
+}
+
+// addTrace filters and samples the given finished trace, then adds the spans
+// which were kept to the writer.
+func (t *tracer) addTrace(trace *finishedTrace) {
+	all := trace.spans
+	t.filterFinishedTrace(trace)
+	t.sampleFinishedTrace(trace)
+	t.releaseSpans(len(all) - len(trace.spans))
+	if len(trace.spans) != 0 {
+		t.applyFlushTags(trace.spans[0])
+		if t.config.traceSummary {
+			summarizeTrace(trace.spans)
+		}
+		if t.config.clockSync {
+			t.correctClockSkew(trace.spans)
+		}
+		t.traceWriter.add(trace.spans)
+		if _, ok := t.traceWriter.(*agentTraceWriter); !ok {
+			// the spans are not held on to
+			t.releaseSpans(len(trace.spans))
+		}
+	}
+	if t.config.spanPooling {
+		// the writer has encoded the spans; they are no longer needed
+		recycleSpans(all)
+	}
+}
+
+// drainQueue adds all the traces waiting in the payload channel to the writer.
+func (t *tracer) drainQueue() {
+	for {
+		select {
+		case trace := <-t.out:
+			t.addTrace(trace)
+		default:
 			return
 		}
 	}
@@ -327,6 +812,104 @@ func (t *tracer) worker(tick <-chan time.Time) {
 type finishedTrace struct {
 	spans    []*span
 	decision samplingDecision
+	priority int // sampling priority of the trace, used when the payload queue overflows
+}
+
+// correctClockSkew shifts the start of the given spans by the offset between the
+// local clock and the agent's clock, when the transport measures it.
+func (t *tracer) correctClockSkew(spans []*span) {
+	tr, ok := t.config.transport.(interface{ agentClockOffset() time.Duration })
+	if !ok {
+		return
+	}
+	offset := int64(tr.agentClockOffset())
+	if offset == 0 {
+		return
+	}
+	for _, s := range spans {
+		s.Lock()
+		s.Start += offset
+		s.Unlock()
+	}
+}
+
+// applyFlushTags sets the tags returned by the function registered using
+// WithFlushTags on s.
+func (t *tracer) applyFlushTags(s *span) {
+	fn := t.config.flushTags
+	if fn == nil {
+		return
+	}
+	tags := fn()
+	if len(tags) == 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for k, v := range tags {
+		s.setMeta(k, v)
+	}
+}
+
+// summarizeTrace sets the metrics described in WithTraceSummary on the local root
+// of the trace made of spans, if it is one of them.
+func summarizeTrace(spans []*span) {
+	var (
+		root    *span
+		errored bool
+	)
+	for _, s := range spans {
+		if s.context != nil && s.context.trace != nil && s.context.trace.root == s {
+			root = s
+		}
+		if s.Error != 0 {
+			errored = true
+		}
+	}
+	if root == nil {
+		return
+	}
+	root.Lock()
+	defer root.Unlock()
+	root.setMetric(keySpanCount, float64(len(spans)))
+	if errored {
+		root.setMetric(keyTraceError, 1)
+	}
+}
+
+// filterFinishedTrace removes the spans matching the span filter or dropped by a span
+// processor from the provided trace, which is considered to be finished, along with
+// their descendants.
+func (t *tracer) filterFinishedTrace(info *finishedTrace) {
+	filter := t.config.spanFilter
+	if (filter == nil && len(t.config.spanProcessors) == 0) || len(info.spans) == 0 {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("Span filter panicked, keeping trace: %v", err)
+		}
+	}()
+	var (
+		kept    = make([]*span, 0, len(info.spans))
+		dropped map[uint64]struct{}
+	)
+	for _, s := range info.spans {
+		// spans are recorded in the order they start, so parents come before their children
+		_, parentDropped := dropped[s.ParentID]
+		if !parentDropped && !s.dropped && (filter == nil || !filter(s)) {
+			kept = append(kept, s)
+			continue
+		}
+		if dropped == nil {
+			dropped = make(map[uint64]struct{})
+		}
+		dropped[s.SpanID] = struct{}{}
+	}
+	if n := len(info.spans) - len(kept); n > 0 {
+		atomic.AddUint32(&t.spansFiltered, uint32(n))
+	}
+	info.spans = kept
 }
 
 // sampleFinishedTrace applies single-span sampling to the provided trace, which is considered to be finished.
@@ -355,15 +938,130 @@ func (t *tracer) sampleFinishedTrace(info *finishedTrace) {
 }
 
 func (t *tracer) pushTrace(trace *finishedTrace) {
+	if t.stopped() {
+		if nt, ok := internal.GetGlobalTracer().(*tracer); ok && nt != t && !nt.stopped() {
+			// Start replaced this tracer while the trace was finishing; the
+			// new tracer takes it over so that restarting loses no traces.
+			nt.pushTrace(trace)
+		}
+		return
+	}
+	if !t.reserveSpans(len(trace.spans)) {
+		atomic.AddUint32(&t.tracesShed, 1)
+		log.Error("maximum number of buffered spans (%d) reached, dropping trace of %d spans", t.config.maxBufferedSpans, len(trace.spans))
+		return
+	}
 	select {
-	case <-t.stop:
+	case t.out <- trace:
+		t.recordQueueLength()
 		return
 	default:
 	}
+	t.recordQueueLength()
+	if trace.priority >= ext.PriorityUserKeep || t.config.overflowPolicy == DropOldest {
+		t.makeRoom(trace)
+		return
+	}
+	t.dropQueuedTrace(trace)
+}
+
+// recordQueueLength updates the largest length of the payload queue.
+func (t *tracer) recordQueueLength() {
+	n := int64(len(t.out))
+	for {
+		max := atomic.LoadInt64(&t.maxQueued)
+		if n <= max || atomic.CompareAndSwapInt64(&t.maxQueued, max, n) {
+			return
+		}
+	}
+}
+
+// maxEvictionScan is the maximum number of queued traces makeRoom looks at to find
+// one to evict.
+const maxEvictionScan = 16
+
+// makeRoom queues trace on the full payload queue by evicting a queued trace which
+// it outranks, so that traces kept by the user or because of errors are the last to
+// be dropped. Only the oldest maxEvictionScan queued traces are looked at, bounding
+// the time spent holding overflowMu; those which are not evicted are requeued. If
+// none of them can be evicted, trace itself is dropped.
+func (t *tracer) makeRoom(trace *finishedTrace) {
+	t.overflowMu.Lock()
+	defer t.overflowMu.Unlock()
+	n := len(t.out)
+	if n > maxEvictionScan {
+		n = maxEvictionScan
+	}
+	for ; n > 0; n-- {
+		var queued *finishedTrace
+		select {
+		case queued = <-t.out:
+		default:
+		}
+		if queued == nil {
+			// the queue was drained in the meantime
+			break
+		}
+		evict := t.outranks(trace, queued)
+		if evict {
+			queued, trace = trace, queued
+		}
+		select {
+		case t.out <- queued:
+			if evict {
+				t.dropQueuedTrace(trace)
+				return
+			}
+		default:
+			// a concurrent push took the free slot; drop the less important
+			// trace and keep looking for room for the other one
+			t.dropQueuedTrace(trace)
+			trace = queued
+		}
+	}
 	select {
 	case t.out <- trace:
 	default:
-		log.Error("payload queue full, dropping %d traces", len(trace.spans))
+		t.dropQueuedTrace(trace)
+	}
+}
+
+// outranks reports whether trace a should be kept over the queued trace b when the
+// payload queue is full. Traces with a higher sampling priority are always kept;
+// among traces of equal priority, the overflow policy decides.
+func (t *tracer) outranks(a, b *finishedTrace) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	return t.config.overflowPolicy == DropOldest
+}
+
+// dropQueuedTrace records that trace was dropped because the payload queue was full.
+func (t *tracer) dropQueuedTrace(trace *finishedTrace) {
+	t.releaseSpans(len(trace.spans))
+	atomic.AddUint32(&t.tracesQueueFull, 1)
+	log.Error("payload queue full, dropping %d traces", len(trace.spans))
+}
+
+// reserveSpans accounts for n spans about to be queued. It reports false if this
+// would exceed the limit set using WithMaxBufferedSpans, in which case the spans
+// must be dropped.
+func (t *tracer) reserveSpans(n int) bool {
+	max := t.config.maxBufferedSpans
+	if max <= 0 {
+		return true
+	}
+	if atomic.AddInt64(&t.spansBuffered, int64(n)) > int64(max) {
+		atomic.AddInt64(&t.spansBuffered, -int64(n))
+		return false
+	}
+	return true
+}
+
+// releaseSpans accounts for n buffered spans which were sent or dropped.
+func (t *tracer) releaseSpans(n int) {
+	if t.config.maxBufferedSpans > 0 && n > 0 {
+		atomic.AddInt64(&t.spansBuffered, -int64(n))
 	}
 }
 
@@ -386,11 +1084,15 @@ func (t *tracer) StartSpan(operationName string, options ...ddtrace.StartSpanOpt
 	if opts.Parent != nil {
 		if ctx, ok := opts.Parent.(*spanContext); ok {
 			context = ctx
-			if pprofContext == nil && ctx.span != nil {
+			if pprofContext == nil {
 				// Inherit the context.Context from parent span if it was propagated
 				// using ChildOf() rather than StartSpanFromContext(), see
 				// applyPPROFLabels() below.
-				pprofContext = ctx.span.pprofCtxActive
+				ctx.mu.RLock()
+				if ctx.span != nil {
+					pprofContext = ctx.span.pprofCtxActive
+				}
+				ctx.mu.RUnlock()
 			}
 		}
 	}
@@ -408,20 +1110,33 @@ func (t *tracer) StartSpan(operationName string, options ...ddtrace.StartSpanOpt
 	if id == 0 {
 		id = generateSpanID(startTime)
 	}
-	// span defaults
-	span := &span{
-		Name:         operationName,
-		Service:      t.config.serviceName,
-		Resource:     operationName,
-		SpanID:       id,
-		TraceID:      id,
-		Start:        startTime,
-		taskEnd:      startExecutionTracerTask(operationName),
-		noDebugStack: t.config.noDebugStack,
+	if context != nil && (id == context.spanID || (context.spanID != 0 && id == context.traceID)) {
+		// The span would be its own ancestor. This happens when a span context
+		// is reused as the parent of the span it belongs to (e.g. via WithSpanID),
+		// and results in a trace the agent is unable to assemble.
+		log.Warn("Span %d can not be a descendant of itself (parent %d, trace %d); starting a new trace.", id, context.spanID, context.traceID)
+		context = nil
 	}
+	// span defaults
+	span := t.allocSpan()
+	span.Name = operationName
+	span.Service = t.config.serviceName
+	span.Resource = operationName
+	span.SpanID = id
+	span.TraceID = id
+	span.Start = startTime
+	span.taskEnd = startExecutionTracerTask(operationName)
+	span.noDebugStack = t.config.noDebugStack
+	span.tagValueLimit = tagValueLimit(t.config.maxTagValueLength)
 	if t.config.hostname != "" {
 		span.setMeta(keyHostname, t.config.hostname)
 	}
+	// parentService holds the service of the local parent, if any; the parent may
+	// be modified concurrently, so it is only read once, under its lock.
+	var (
+		parentService string
+		localParent   bool
+	)
 	if context != nil {
 		// this is a child span
 		span.TraceID = context.traceID
@@ -429,11 +1144,20 @@ func (t *tracer) StartSpan(operationName string, options ...ddtrace.StartSpanOpt
 		if p, ok := context.samplingPriority(); ok {
 			span.setMetric(keySamplingPriority, float64(p))
 		}
-		if context.span != nil {
-			// local parent, inherit service
-			context.span.RLock()
-			span.Service = context.span.Service
-			context.span.RUnlock()
+		// holding the context's lock keeps the parent from being recycled
+		context.mu.RLock()
+		if parent := context.span; parent != nil {
+			// local parent, inherit service and the configured tags
+			localParent = true
+			parent.RLock()
+			parentService = parent.Service
+			span.Service = parentService
+			for _, k := range t.config.inheritedTags {
+				if v, ok := parent.Meta[k]; ok {
+					span.setMeta(k, v)
+				}
+			}
+			parent.RUnlock()
 		} else {
 			// remote parent
 			if context.origin != "" {
@@ -441,19 +1165,36 @@ func (t *tracer) StartSpan(operationName string, options ...ddtrace.StartSpanOpt
 				span.setMeta(keyOrigin, context.origin)
 			}
 		}
+		context.mu.RUnlock()
 	}
 	span.context = newSpanContext(span, context)
-	if context == nil || context.span == nil {
-		// this is either a root span or it has a remote parent, we should add the PID.
+	if origin, ok := opts.Tags[keyOrigin].(string); ok && context == nil {
+		// root span; the origin is propagated to the rest of the trace through its context
+		span.context.origin = origin
+	}
+	if !localParent {
+		// this is either a root span or it has a remote parent, we should add the PID
+		// and the versions which produced the trace.
 		span.setMeta(ext.Pid, t.pid)
+		span.setMeta(keyTracerVersion, Version)
+		span.setMeta(keyRuntime, runtime.Version())
 		if _, ok := opts.Tags[ext.ServiceName]; !ok && t.config.runtimeMetrics {
 			// this is a root span in the global service; runtime metrics should
 			// be linked to it:
 			span.setMeta("language", "go")
 		}
 	}
+	if fn := t.config.contextTags; fn != nil && opts.Context != nil {
+		for k, v := range fn(opts.Context) {
+			span.SetTag(k, v)
+		}
+	}
 	// add tags from options
 	for k, v := range opts.Tags {
+		if k == keyOrigin && context != nil {
+			// the origin is inherited from the parent
+			continue
+		}
 		span.SetTag(k, v)
 	}
 	// add global tags
@@ -465,7 +1206,7 @@ func (t *tracer) StartSpan(operationName string, options ...ddtrace.StartSpanOpt
 			span.Service = newSvc
 		}
 	}
-	if context == nil || context.span == nil || context.span.Service != span.Service {
+	if !localParent || parentService != span.Service {
 		span.setMetric(keyTopLevel, 1)
 		// all top level spans are measured. So the measured tag is redundant.
 		delete(span.Metrics, keyMeasured)
@@ -480,7 +1221,11 @@ func (t *tracer) StartSpan(operationName string, options ...ddtrace.StartSpanOpt
 	}
 	if _, ok := span.context.samplingPriority(); !ok {
 		// if not already sampled or a brand new trace, sample it
-		t.sample(span)
+		if ss, ok := sharedSamplingFromContext(opts.Context); ok && context == nil {
+			ss.sample(t, span)
+		} else {
+			t.sample(span)
+		}
 	}
 	if t.config.profilerHotspots || t.config.profilerEndpoints {
 		t.applyPPROFLabels(pprofContext, span)
@@ -495,14 +1240,33 @@ func (t *tracer) StartSpan(operationName string, options ...ddtrace.StartSpanOpt
 		log.Debug("Started Span: %v, Operation: %s, Resource: %s, Tags: %v, %v",
 			span, span.Name, span.Resource, span.Meta, span.Metrics)
 	}
+	if t.config.captureCaller {
+		if caller, ok := callerLocation(); ok {
+			span.setMeta(keyCaller, caller)
+		}
+	}
+	if span.context.trace.root == span && t.resourceIgnored(span.Resource) {
+		span.context.trace.ignore()
+	}
+	if len(t.config.spanProcessors) > 0 {
+		// the processors of the tracer starting the span also end it, whichever
+		// tracer is running when it finishes
+		span.processors = t.config.spanProcessors
+		span.processStart()
+	}
 	return span
 }
 
 // generateSpanID returns a random uint64 that has been XORd with the startTime.
 // This is done to get around the 32-bit random seed limitation that may create collisions if there is a large number
-// of go services all generating spans.
+// of go services all generating spans. The returned ID is never zero, which would mean
+// "no parent" for the span's children.
 func generateSpanID(startTime int64) uint64 {
-	return random.Uint64() ^ uint64(startTime)
+	for {
+		if id := random.Uint64() ^ uint64(startTime); id != 0 {
+			return id
+		}
+	}
 }
 
 // applyPPROFLabels applies pprof labels for the profiler's code hotspots and
@@ -547,11 +1311,43 @@ func (t *tracer) Stop() {
 	})
 	t.stats.Stop()
 	t.wg.Wait()
+	if t.config.noWorker {
+		// there is no worker to drain the queue, so the final flush
+		// is done here
+		t.manualMu.Lock()
+		defer t.manualMu.Unlock()
+		t.drainQueue()
+	}
 	t.traceWriter.stop()
 	t.config.statsd.Close()
 	appsec.Stop()
 }
 
+// pollSamplingRates polls the agent for its sampling rates at the given interval,
+// until the tracer is stopped.
+func (t *tracer) pollSamplingRates(w *agentTraceWriter, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.pollRates(interval)
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// stopped reports whether Stop was called.
+func (t *tracer) stopped() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
+
 // Inject uses the configured or default TextMap Propagator.
 func (t *tracer) Inject(ctx ddtrace.SpanContext, carrier interface{}) error {
 	return t.config.propagator.Inject(ctx, carrier)
@@ -571,12 +1367,16 @@ func (t *tracer) sample(span *span) {
 		// sampling decision was already made
 		return
 	}
+	if samplingDecision(atomic.LoadUint32((*uint32)(&span.context.trace.samplingDecision))) == decisionDrop {
+		// the trace was already dropped by the sampler
+		return
+	}
 	sampler := t.config.sampler
 	if !sampler.Sample(span) {
 		span.context.trace.drop()
 		return
 	}
-	if rs, ok := sampler.(RateSampler); ok && rs.Rate() < 1 {
+	if rs, ok := sampler.(interface{ Rate() float64 }); ok && rs.Rate() < 1 {
 		span.setMetric(sampleRateMetricKey, rs.Rate())
 	}
 	if t.rulesSampling.SampleTrace(span) {
@@ -9,13 +9,17 @@ import (
 	"context"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -187,6 +191,16 @@ func TestTracerStart(t *testing.T) {
 		}
 	})
 
+	t.Run("flush", func(t *testing.T) {
+		// flushing is valid whether or not the tracer is started or
+		// spans were created
+		Flush()
+		Start(withTransport(newDummyTransport()))
+		Flush()
+		Stop()
+		Flush()
+	})
+
 	t.Run("deadlock/api", func(t *testing.T) {
 		Stop()
 		Stop()
@@ -281,6 +295,62 @@ func TestTracerStartSpan(t *testing.T) {
 		child := tracer.StartSpan("home/user", Measured(), ChildOf(parent.context)).(*span)
 		assert.Equal(t, 1.0, child.Metrics[keyMeasured])
 	})
+
+	t.Run("set_measured", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer := newTracer()
+		defer tracer.Stop()
+		root := tracer.StartSpan("web.request").(*span)
+		child := tracer.StartSpan("db.query", ChildOf(root.context)).(*span)
+		assert.NotContains(child.Metrics, keyMeasured)
+
+		SetMeasured(child, true)
+		assert.Equal(1.0, child.Metrics[keyMeasured])
+		SetMeasured(child, false)
+		assert.NotContains(child.Metrics, keyMeasured)
+
+		// root spans are top level, so they are measured already
+		SetMeasured(root, true)
+		assert.NotContains(root.Metrics, keyMeasured)
+		assert.Equal(1.0, root.Metrics[keyTopLevel])
+
+		child.Finish()
+		SetMeasured(child, true)
+		assert.NotContains(child.Metrics, keyMeasured)
+		SetMeasured(nil, true)
+	})
+}
+
+func TestStartSpanFromTextMap(t *testing.T) {
+	trc, _, _, stop := startTestTracer(t)
+	defer stop()
+
+	t.Run("propagated", func(t *testing.T) {
+		assert := assert.New(t)
+		producer := trc.StartSpan("kafka.produce", Tag(ext.ManualKeep, true)).(*span)
+		producer.SetBaggageItem("tenant", "acme")
+		carrier := map[string]string{}
+		assert.NoError(Inject(producer.Context(), TextMapCarrier(carrier)))
+
+		consumer := StartSpanFromTextMap("kafka.consume", carrier, ServiceName("worker")).(*span)
+		assert.Equal(producer.TraceID, consumer.TraceID)
+		assert.Equal(producer.SpanID, consumer.ParentID)
+		assert.Equal("worker", consumer.Service)
+		assert.Equal("acme", consumer.BaggageItem("tenant"))
+		p, ok := consumer.context.samplingPriority()
+		assert.True(ok)
+		assert.Equal(ext.PriorityUserKeep, p)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		assert := assert.New(t)
+		for _, carrier := range []map[string]string{nil, {"unrelated": "value"}, {DefaultTraceIDHeader: "not a number"}} {
+			root := StartSpanFromTextMap("kafka.consume", carrier, ServiceName("worker")).(*span)
+			assert.Zero(root.ParentID)
+			assert.Equal(root.SpanID, root.TraceID)
+			assert.Equal("worker", root.Service)
+		}
+	})
 }
 
 func TestSamplingDecision(t *testing.T) {
@@ -505,6 +575,343 @@ func TestTracerStartChildSpan(t *testing.T) {
 		assert.Equal(1.0, root.Metrics[keyTopLevel])
 		assert.NotContains(child.Metrics, keyTopLevel)
 	})
+
+	t.Run("cycle", func(t *testing.T) {
+		assert := assert.New(t)
+		tp := new(log.RecordLogger)
+		tracer := newTracer(WithLogger(tp))
+		defer tracer.Stop()
+		root := tracer.StartSpan("web.request").(*span)
+		child := tracer.StartSpan("db.query", ChildOf(root.Context())).(*span)
+		// the child's context is reused to create a span with the same ID
+		cycle := tracer.StartSpan("db.query", ChildOf(child.Context()), WithSpanID(child.SpanID)).(*span)
+		assert.Equal(child.SpanID, cycle.SpanID)
+		assert.Equal(cycle.SpanID, cycle.TraceID)
+		assert.Zero(cycle.ParentID)
+		assert.NotEqual(child.context.trace, cycle.context.trace)
+		// a span that would reference the trace root as its own parent
+		cycle = tracer.StartSpan("db.query", ChildOf(child.Context()), WithSpanID(root.SpanID)).(*span)
+		assert.Zero(cycle.ParentID)
+		assert.Equal(cycle.SpanID, cycle.TraceID)
+		assert.Contains(strings.Join(tp.Logs(), "\n"), "can not be a descendant of itself")
+	})
+}
+
+func TestSpanPooling(t *testing.T) {
+	assert := assert.New(t)
+	tracer, transport, flush, stop := startTestTracer(t, WithSpanPooling(true))
+	defer stop()
+
+	for i := 0; i < 10; i++ {
+		root := tracer.StartSpan("web.request", Tag("key", i))
+		assert.NotContains(root.(*span).Meta, "key2")
+		root.SetTag("key2", "value")
+		child := tracer.StartSpan("db.query", ChildOf(root.Context())).(*span)
+		assert.NotContains(child.Meta, "key")
+		assert.NotContains(child.Meta, "key2")
+		assert.Zero(child.Duration)
+		assert.False(child.finished)
+		child.Finish()
+		root.Finish()
+		flush(i + 1)
+	}
+	for i, trace := range transport.Traces() {
+		assert.Len(trace, 2)
+		assert.Equal(float64(i), trace[0].Metrics["key"])
+		assert.Equal("value", trace[0].Meta["key2"])
+	}
+}
+
+func TestRecycleSpans(t *testing.T) {
+	assert := assert.New(t)
+	s := newSpan("name", "service", "resource", 1, 2, 3)
+	s.SetTag("key", "value")
+	s.SetTag("metric", 1)
+	s.Finish()
+	meta := s.Meta
+	ctx := s.context
+	recycleSpans([]*span{s})
+	assert.False(ctx.local(), "the context must stop referring to the recycled span")
+	_, ok := ctx.meta("key")
+	assert.False(ok)
+	assert.Empty(s.Meta)
+	assert.Empty(s.Metrics)
+	assert.NotNil(s.Meta)
+	assert.Empty(meta)
+	assert.Zero(s.Name)
+	assert.Zero(s.SpanID)
+	assert.Zero(s.Start)
+	assert.False(s.finished)
+	assert.Nil(s.context)
+}
+
+func TestTracerUpstreamSamplingDecision(t *testing.T) {
+	// a sampling decision received from upstream applies to the local spans of
+	// the trace, even when the local sampler would have dropped them
+	for _, priority := range []int{ext.PriorityAutoKeep, ext.PriorityUserKeep} {
+		t.Run(strconv.Itoa(priority), func(t *testing.T) {
+			assert := assert.New(t)
+			tracer, transport, flush, stop := startTestTracer(t, WithSampler(NewRateSampler(0)))
+			defer stop()
+			sctx, err := tracer.Extract(TextMapCarrier{
+				DefaultTraceIDHeader:  "1",
+				DefaultParentIDHeader: "2",
+				DefaultPriorityHeader: strconv.Itoa(priority),
+			})
+			assert.NoError(err)
+			sp := tracer.StartSpan("op", ChildOf(sctx)).(*span)
+			sp.Finish()
+			flush(1)
+			assert.EqualValues(priority, sp.Metrics[keySamplingPriority])
+			assert.Len(transport.Traces(), 1)
+		})
+	}
+}
+
+// sequenceSource is a rand.Source64 returning the given values in order.
+type sequenceSource []uint64
+
+func (s *sequenceSource) Uint64() uint64 {
+	v := (*s)[0]
+	*s = (*s)[1:]
+	return v
+}
+
+func (s *sequenceSource) Int63() int64 { return int64(s.Uint64() >> 1) }
+
+func (s *sequenceSource) Seed(int64) {}
+
+func TestGenerateSpanIDNonZero(t *testing.T) {
+	defer func(old *rand.Rand) { random = old }(random)
+	start := now()
+	// the first random number XORd with the start time results in zero
+	random = rand.New(&sequenceSource{uint64(start), 42})
+	assert.Equal(t, 42^uint64(start), generateSpanID(start))
+}
+
+func TestTracerStartSpanWithParentIDs(t *testing.T) {
+	t.Run("child", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer := newTracer()
+		defer tracer.Stop()
+		sp := tracer.StartSpan("web.request", WithParentIDs(1234, 5678), WithSpanID(42)).(*span)
+		assert.Equal(uint64(1234), sp.TraceID)
+		assert.Equal(uint64(5678), sp.ParentID)
+		assert.Equal(uint64(42), sp.SpanID)
+		assert.Equal(1.0, sp.Metrics[keyTopLevel])
+		_, ok := sp.context.samplingPriority()
+		assert.True(ok)
+	})
+
+	t.Run("root", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer := newTracer()
+		defer tracer.Stop()
+		sp := tracer.StartSpan("web.request", WithParentIDs(1234, 0), WithSpanID(1234)).(*span)
+		assert.Equal(uint64(1234), sp.TraceID)
+		assert.Equal(uint64(1234), sp.SpanID)
+		assert.Zero(sp.ParentID)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		assert := assert.New(t)
+		tp := new(log.RecordLogger)
+		tracer := newTracer(WithLogger(tp))
+		defer tracer.Stop()
+		sp := tracer.StartSpan("web.request", WithParentIDs(0, 5678)).(*span)
+		assert.Equal(sp.SpanID, sp.TraceID)
+		assert.Zero(sp.ParentID)
+		// a span can not be its own parent
+		sp = tracer.StartSpan("web.request", WithParentIDs(1234, 42), WithSpanID(42)).(*span)
+		assert.Equal(uint64(42), sp.TraceID)
+		assert.Zero(sp.ParentID)
+		logs := strings.Join(tp.Logs(), "\n")
+		assert.Contains(logs, "the trace ID can not be zero")
+		assert.Contains(logs, "can not be a descendant of itself")
+	})
+}
+
+func TestTracerStartSpanInheritedTags(t *testing.T) {
+	assert := assert.New(t)
+	tracer := newTracer(WithInheritedTags("request.id", "user.id"))
+	defer tracer.Stop()
+	root := tracer.StartSpan("web.request", Tag("request.id", "abc"), Tag("other", "x")).(*span)
+	child := tracer.StartSpan("db.query", ChildOf(root.Context()), Tag("user.id", "1")).(*span)
+	grandchild := tracer.StartSpan("db.query", ChildOf(child.Context())).(*span)
+	assert.Equal("abc", child.Meta["request.id"])
+	assert.Equal("1", child.Meta["user.id"])
+	assert.NotContains(child.Meta, "other")
+	assert.Equal("abc", grandchild.Meta["request.id"])
+	assert.Equal("1", grandchild.Meta["user.id"])
+
+	// tags are not inherited by default
+	tracer2 := newTracer()
+	defer tracer2.Stop()
+	root = tracer2.StartSpan("web.request", Tag("request.id", "abc")).(*span)
+	child = tracer2.StartSpan("db.query", ChildOf(root.Context())).(*span)
+	assert.NotContains(child.Meta, "request.id")
+}
+
+func TestFlushTags(t *testing.T) {
+	assert := assert.New(t)
+	var version atomic.Value
+	version.Store("v1")
+	tracer, transport, flush, stop := startTestTracer(t,
+		WithGlobalTag("version", "v1"),
+		WithFlushTags(func() map[string]string {
+			return map[string]string{"version": version.Load().(string)}
+		}),
+	)
+	defer stop()
+
+	root := tracer.StartSpan("web.request")
+	child := tracer.StartSpan("db.query", ChildOf(root.Context()))
+	version.Store("v2")
+	child.Finish()
+	root.Finish()
+	flush(1)
+
+	traces := transport.Traces()
+	assert.Len(traces, 1)
+	assert.Equal("v2", traces[0][0].Meta["version"])
+	assert.Equal("v1", traces[0][1].Meta["version"])
+}
+
+func TestTraceSummary(t *testing.T) {
+	assert := assert.New(t)
+	tracer, transport, flush, stop := startTestTracer(t, WithTraceSummary(true))
+	defer stop()
+
+	root := tracer.StartSpan("web.request")
+	child := tracer.StartSpan("service.call", ChildOf(root.Context()))
+	tracer.StartSpan("db.query", ChildOf(child.Context())).Finish(WithError(errors.New("timeout")))
+	child.Finish()
+	root.Finish()
+
+	// the local root of a distributed trace has a remote parent
+	remote := &spanContext{traceID: 42, spanID: 43}
+	tracer.StartSpan("consumer", ChildOf(remote)).Finish()
+	flush(2)
+
+	traces := transport.Traces()
+	assert.Len(traces, 2)
+	for _, s := range traces[0] {
+		if s.Name == "web.request" {
+			assert.Equal(3.0, s.Metrics[keySpanCount])
+			assert.Equal(1.0, s.Metrics[keyTraceError])
+		} else {
+			assert.NotContains(s.Metrics, keySpanCount)
+			assert.NotContains(s.Metrics, keyTraceError)
+		}
+	}
+	assert.Equal(1.0, traces[1][0].Metrics[keySpanCount])
+	assert.NotContains(traces[1][0].Metrics, keyTraceError)
+
+	// traces sent without their local root are not summarized
+	root = tracer.StartSpan("web.request")
+	child = tracer.StartSpan("db.query", ChildOf(root.Context()))
+	summarizeTrace([]*span{child.(*span)})
+	assert.NotContains(child.(*span).Metrics, keySpanCount)
+}
+
+func TestTracerVersionTags(t *testing.T) {
+	assert := assert.New(t)
+	tracer := newTracer(withTransport(newDummyTransport()))
+	defer tracer.Stop()
+
+	root := tracer.StartSpan("web.request").(*span)
+	child := tracer.StartSpan("db.query", ChildOf(root.Context())).(*span)
+	remote := tracer.StartSpan("consumer", ChildOf(&spanContext{traceID: 42, spanID: 43})).(*span)
+	for _, s := range []*span{root, remote} {
+		assert.Equal(Version, s.Meta[keyTracerVersion])
+		assert.Equal(runtime.Version(), s.Meta[keyRuntime])
+	}
+	assert.NotContains(child.Meta, keyTracerVersion)
+	assert.NotContains(child.Meta, keyRuntime)
+}
+
+// skewedTransport is a dummyTransport reporting a fixed agent clock offset.
+type skewedTransport struct {
+	*dummyTransport
+	offset time.Duration
+}
+
+func (t *skewedTransport) agentClockOffset() time.Duration { return t.offset }
+
+func TestClockSync(t *testing.T) {
+	for name, enabled := range map[string]bool{"enabled": true, "disabled": false} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			transport := &skewedTransport{newDummyTransport(), time.Hour}
+			tracer, _, flush, stop := startTestTracer(t, withTransport(transport), WithClockSync(enabled))
+			defer stop()
+
+			root := tracer.StartSpan("web.request").(*span)
+			child := tracer.StartSpan("db.query", ChildOf(root.Context())).(*span)
+			rootStart, childStart := root.Start, child.Start
+			child.Finish()
+			root.Finish()
+			rootDuration := root.Duration
+			assert.Eventually(func() bool {
+				flush(-1)
+				return transport.Len() == 1
+			}, time.Second, 5*time.Millisecond)
+
+			var offset int64
+			if enabled {
+				offset = int64(time.Hour)
+			}
+			sent := transport.Traces()[0]
+			assert.Equal(rootStart+offset, sent[0].Start)
+			assert.Equal(childStart+offset, sent[1].Start)
+			assert.Equal(rootDuration, sent[0].Duration)
+		})
+	}
+}
+
+func TestSpanFilter(t *testing.T) {
+	t.Run("filter", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer, transport, flush, stop := startTestTracer(t, WithSpanFilter(func(s Span) bool {
+			sp := s.(*span)
+			return sp.Resource == "/health" || sp.Name == "noisy"
+		}))
+		defer stop()
+
+		// the root matches: the whole trace is dropped
+		root := tracer.StartSpan("web.request", ResourceName("/health"))
+		tracer.StartSpan("db.query", ChildOf(root.Context())).Finish()
+		root.Finish()
+
+		// a child matches: it is dropped along with its descendants
+		root = tracer.StartSpan("web.request", ResourceName("/users"))
+		noisy := tracer.StartSpan("noisy", ChildOf(root.Context()))
+		tracer.StartSpan("db.query", ChildOf(noisy.Context())).Finish()
+		noisy.Finish()
+		tracer.StartSpan("cache.get", ChildOf(root.Context())).Finish()
+		root.Finish()
+		flush(1)
+
+		traces := transport.Traces()
+		assert.Len(traces, 1)
+		var names []string
+		for _, s := range traces[0] {
+			names = append(names, s.Name)
+		}
+		assert.ElementsMatch([]string{"web.request", "cache.get"}, names)
+		assert.Equal(uint32(4), atomic.LoadUint32(&tracer.spansFiltered))
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer, transport, flush, stop := startTestTracer(t, WithSpanFilter(func(s Span) bool {
+			panic("oops")
+		}))
+		defer stop()
+		tracer.StartSpan("web.request").Finish()
+		flush(1)
+		assert.Len(transport.Traces(), 1)
+	})
 }
 
 func TestTracerBaggagePropagation(t *testing.T) {
@@ -548,6 +955,26 @@ func TestStartSpanOrigin(t *testing.T) {
 	assert.Equal("synthetics", carrier2[originHeader])
 }
 
+func TestStartSpanWithOrigin(t *testing.T) {
+	assert := assert.New(t)
+
+	tracer := newTracer()
+	defer tracer.Stop()
+
+	root := tracer.StartSpan("root", Origin("synthetics"))
+	assert.Equal("synthetics", root.(*span).Meta[keyOrigin])
+
+	// children inherit the origin, and can not override it
+	child := tracer.StartSpan("child", ChildOf(root.Context()), Origin("lambda"))
+	assert.Equal("synthetics", child.Context().(*spanContext).origin)
+	assert.Empty(child.(*span).Meta[keyOrigin])
+
+	carrier := TextMapCarrier(map[string]string{})
+	err := tracer.Inject(child.Context(), carrier)
+	assert.Nil(err)
+	assert.Equal("synthetics", carrier[originHeader])
+}
+
 func TestPropagationDefaults(t *testing.T) {
 	assert := assert.New(t)
 
@@ -811,6 +1238,72 @@ func TestTracerSampler(t *testing.T) {
 	assert.True(ok)
 }
 
+func TestTracerSampleRateMetrics(t *testing.T) {
+	// startKept returns a root span kept by the tracer's samplers.
+	startKept := func(t *testing.T, tracer *tracer) *span {
+		for i := 0; i < 1000; i++ {
+			sp := tracer.StartSpan("web.request").(*span)
+			if samplingDecision(atomic.LoadUint32((*uint32)(&sp.context.trace.samplingDecision))) != decisionDrop {
+				return sp
+			}
+		}
+		t.Fatal("no span was kept")
+		return nil
+	}
+
+	t.Run("all", func(t *testing.T) {
+		tracer := newTracer(withTransport(newDefaultTransport()))
+		defer tracer.Stop()
+		sp := startKept(t, tracer)
+		// a rate of 1 is implied
+		assert.NotContains(t, sp.Metrics, sampleRateMetricKey)
+		// the priority sampler records its own rate
+		assert.Equal(t, 1.0, sp.Metrics[keySamplingPriorityRate])
+	})
+
+	t.Run("rate", func(t *testing.T) {
+		tracer := newTracer(withTransport(newDefaultTransport()), WithSampler(NewRateSampler(0.5)))
+		defer tracer.Stop()
+		assert.Equal(t, 0.5, startKept(t, tracer).Metrics[sampleRateMetricKey])
+	})
+
+	t.Run("adaptive", func(t *testing.T) {
+		sampler := NewAdaptiveSampler(1000)
+		tracer := newTracer(withTransport(newDefaultTransport()), WithSampler(sampler))
+		defer tracer.Stop()
+		sp := startKept(t, tracer)
+		if rate := sampler.Rate(); rate < 1 {
+			assert.Equal(t, rate, sp.Metrics[sampleRateMetricKey])
+		} else {
+			assert.NotContains(t, sp.Metrics, sampleRateMetricKey)
+		}
+	})
+
+	t.Run("rules", func(t *testing.T) {
+		tracer := newTracer(withTransport(newDefaultTransport()), WithSamplingRules([]SamplingRule{RateRule(0.5)}))
+		defer tracer.Stop()
+		sp := tracer.StartSpan("web.request").(*span)
+		assert.Equal(t, 0.5, sp.Metrics[keyRulesSamplerAppliedRate])
+		assert.NotContains(t, sp.Metrics, keySamplingPriorityRate)
+	})
+}
+
+func TestTracerSamplingReproducible(t *testing.T) {
+	decisions := func() []bool {
+		tracer := newTracer(withTransport(newDefaultTransport()), WithSampler(NewRateSampler(0.5)))
+		defer tracer.Stop()
+		var kept []bool
+		for id := uint64(1); id <= 100; id++ {
+			root := tracer.StartSpan("web.request", WithSpanID(id)).(*span)
+			keep := samplingDecision(atomic.LoadUint32((*uint32)(&root.context.trace.samplingDecision))) != decisionDrop
+			assert.Equal(t, sampledByRate(id, 0.5), keep)
+			kept = append(kept, keep)
+		}
+		return kept
+	}
+	assert.Equal(t, decisions(), decisions())
+}
+
 func TestTracerPrioritySampler(t *testing.T) {
 	assert := assert.New(t)
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -977,6 +1470,76 @@ func TestTracerParentFinishBeforeChild(t *testing.T) {
 	assert.Equal(parent.SpanID, traces[0][0].ParentID, "child should refer to parent, even if they have been flushed separately")
 }
 
+func TestTracerParentFinishConcurrentWithChild(t *testing.T) {
+	assert := assert.New(t)
+	tracer, transport, flush, stop := startTestTracer(t)
+	defer stop()
+
+	parent := tracer.newRootSpan("pylons.request", "pylons", "/")
+	sctx := parent.Context()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tracer.StartSpan("background.job", ChildOf(sctx)).Finish()
+		}()
+	}
+	parent.Finish()
+	wg.Wait()
+
+	var spans []*span
+	timeout := time.After(time.Second * timeMultiplicator)
+	for len(spans) < 11 {
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for spans, got %d", len(spans))
+		default:
+		}
+		flush(-1)
+		for _, trace := range transport.Traces() {
+			spans = append(spans, trace...)
+		}
+	}
+	assert.Len(spans, 11)
+	for _, s := range spans {
+		assert.Equal(parent.TraceID, s.TraceID)
+		if s.SpanID != parent.SpanID {
+			assert.Equal(parent.SpanID, s.ParentID)
+		}
+	}
+}
+
+func TestTracerStartChildWhileParentModified(t *testing.T) {
+	// children read the parent's fields under its lock; run with -race
+	assert := assert.New(t)
+	tracer, _, _, stop := startTestTracer(t)
+	defer stop()
+
+	parent := tracer.newRootSpan("pylons.request", "pylons", "/")
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			parent.SetTag(ext.ServiceName, "service-"+strconv.Itoa(i))
+			parent.SetTag(ext.ResourceName, "/"+strconv.Itoa(i))
+			parent.SetTag("key", i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			child := tracer.StartSpan("child", ChildOf(parent.Context())).(*span)
+			assert.Equal(parent.TraceID, child.TraceID)
+			assert.Equal(parent.SpanID, child.ParentID)
+			child.Finish()
+		}
+	}()
+	wg.Wait()
+	parent.Finish()
+}
+
 func TestTracerConcurrentMultipleSpans(t *testing.T) {
 	assert := assert.New(t)
 	tracer, transport, flush, stop := startTestTracer(t)
@@ -1225,11 +1788,11 @@ func TestPushPayload(t *testing.T) {
 	s.Meta["key"] = strings.Repeat("X", payloadSizeLimit/2+10)
 
 	// half payload size reached
-	tracer.pushTrace(&finishedTrace{[]*span{s}, decisionKeep})
+	tracer.pushTrace(&finishedTrace{spans: []*span{s}, decision: decisionKeep})
 	tracer.awaitPayload(t, 1)
 
 	// payload size exceeded
-	tracer.pushTrace(&finishedTrace{[]*span{s}, decisionKeep})
+	tracer.pushTrace(&finishedTrace{spans: []*span{s}, decision: decisionKeep})
 	flush(2)
 }
 
@@ -1263,10 +1826,228 @@ func TestPushTrace(t *testing.T) {
 		tracer.pushTrace(&finishedTrace{spans: make([]*span, i)})
 	}
 	assert.Len(tracer.out, payloadQueueSize)
+	assert.EqualValues(2, atomic.LoadUint32(&tracer.tracesQueueFull))
 	log.Flush()
 	assert.True(len(tp.Lines()) >= 1)
 }
 
+func TestTracerQueueSize(t *testing.T) {
+	defer log.UseLogger(new(testLogger))()
+	for n, want := range map[int]int{0: payloadQueueSize, -1: payloadQueueSize, 10: 10} {
+		tracer := newUnstartedTracer(WithQueueSize(n))
+		for i := 0; i < want+2; i++ {
+			tracer.pushTrace(&finishedTrace{spans: make([]*span, 1)})
+		}
+		assert.Len(t, tracer.out, want)
+		assert.EqualValues(t, 2, atomic.LoadUint32(&tracer.tracesQueueFull))
+	}
+}
+
+// BenchmarkPushTraceDuringFlush measures the latency of queueing finished traces
+// while the worker is busy flushing payloads, which must not block producers.
+func BenchmarkPushTraceDuringFlush(b *testing.B) {
+	tracer, _, _, stop := startTestTracer(b, WithQueueSize(10000))
+	defer stop()
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				tracer.flushSync()
+			}
+		}
+	}()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			tracer.pushTrace(&finishedTrace{spans: []*span{newBasicSpan("op")}, decision: decisionKeep})
+		}
+	})
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+}
+
+func TestPushTraceOverflowPolicy(t *testing.T) {
+	push := func(tracer *tracer, n int) {
+		for i := 0; i < n; i++ {
+			tracer.pushTrace(&finishedTrace{spans: make([]*span, i)})
+		}
+	}
+	defer log.UseLogger(new(testLogger))()
+
+	t.Run("newest", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer := newUnstartedTracer(WithOverflowPolicy(DropNewest))
+		push(tracer, payloadQueueSize+2)
+		assert.Len(tracer.out, payloadQueueSize)
+		assert.EqualValues(2, atomic.LoadUint32(&tracer.tracesQueueFull))
+		assert.Len((<-tracer.out).spans, 0)
+	})
+
+	t.Run("oldest", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer := newUnstartedTracer(WithOverflowPolicy(DropOldest))
+		push(tracer, payloadQueueSize+2)
+		assert.Len(tracer.out, payloadQueueSize)
+		assert.EqualValues(2, atomic.LoadUint32(&tracer.tracesQueueFull))
+		assert.Len((<-tracer.out).spans, 2)
+		var last *finishedTrace
+		for len(tracer.out) > 0 {
+			last = <-tracer.out
+		}
+		assert.Len(last.spans, payloadQueueSize+1)
+	})
+
+	t.Run("priority", func(t *testing.T) {
+		for _, policy := range []OverflowPolicy{DropNewest, DropOldest} {
+			assert := assert.New(t)
+			tracer := newUnstartedTracer(WithOverflowPolicy(policy))
+			for i := 0; i < payloadQueueSize; i++ {
+				p := ext.PriorityAutoKeep
+				if i%2 == 0 {
+					p = ext.PriorityUserKeep
+				}
+				tracer.pushTrace(&finishedTrace{spans: make([]*span, i), priority: p})
+			}
+			for i := 0; i < payloadQueueSize; i++ {
+				tracer.pushTrace(&finishedTrace{spans: make([]*span, 1), priority: ext.PriorityUserKeep})
+			}
+			assert.Len(tracer.out, payloadQueueSize)
+			assert.EqualValues(payloadQueueSize, atomic.LoadUint32(&tracer.tracesQueueFull))
+			var kept int
+			for len(tracer.out) > 0 {
+				trace := <-tracer.out
+				assert.Equal(ext.PriorityUserKeep, trace.priority)
+				if len(trace.spans) != 1 {
+					kept++
+					assert.Equal(0, len(trace.spans)%2)
+				}
+			}
+			if policy == DropNewest {
+				// the kept traces which were queued first survive
+				assert.Equal(payloadQueueSize/2, kept)
+			}
+		}
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer := newUnstartedTracer(WithOverflowPolicy(DropNewest))
+		for i := 0; i < payloadQueueSize; i++ {
+			p := ext.PriorityUserKeep
+			if i == payloadQueueSize-1 {
+				p = ext.PriorityAutoKeep
+			}
+			tracer.pushTrace(&finishedTrace{spans: make([]*span, i), priority: p})
+		}
+		tracer.pushTrace(&finishedTrace{spans: make([]*span, 1), priority: ext.PriorityUserKeep})
+		// the trace to evict is beyond the scanned ones: the new trace is dropped
+		// and only the scanned traces are moved to the back of the queue
+		assert.Len(tracer.out, payloadQueueSize)
+		assert.EqualValues(1, atomic.LoadUint32(&tracer.tracesQueueFull))
+		assert.Len((<-tracer.out).spans, maxEvictionScan)
+	})
+}
+
+func TestPushTraceRestart(t *testing.T) {
+	old, oldTransport, _, stop := startTestTracer(t)
+	defer stop()
+	trc, transport, flush, stopNew := startTestTracer(t)
+	defer stopNew()
+	old.Stop()
+
+	// the trace finished right before the old tracer was replaced and stopped
+	old.pushTrace(&finishedTrace{spans: []*span{newBasicSpan("web.request")}, decision: decisionKeep})
+	flush(1)
+	assert.Equal(t, "web.request", transport.Traces()[0][0].Name)
+	assert.Equal(t, 0, oldTransport.Len())
+
+	// a stopped tracer which was not replaced drops the trace
+	trc.Stop()
+	trc.pushTrace(&finishedTrace{spans: []*span{newBasicSpan("web.request")}})
+	assert.Len(t, trc.out, 0)
+}
+
+func TestPushTraceMaxBufferedSpans(t *testing.T) {
+	assert := assert.New(t)
+	defer log.UseLogger(new(testLogger))()
+	tracer := newUnstartedTracer(WithMaxBufferedSpans(10), withTransport(newDummyTransport()))
+	newTrace := func() *finishedTrace {
+		trace := &finishedTrace{decision: decisionKeep}
+		for i := 0; i < 4; i++ {
+			trace.spans = append(trace.spans, newBasicSpan("op"))
+		}
+		return trace
+	}
+	for i := 0; i < 3; i++ {
+		tracer.pushTrace(newTrace())
+	}
+	assert.Len(tracer.out, 2)
+	assert.EqualValues(1, atomic.LoadUint32(&tracer.tracesShed))
+	assert.EqualValues(8, atomic.LoadInt64(&tracer.spansBuffered))
+
+	// spans buffered in the payload still count until they are sent
+	tracer.addTrace(<-tracer.out)
+	assert.EqualValues(8, atomic.LoadInt64(&tracer.spansBuffered))
+	tracer.traceWriter.flush()
+	tracer.traceWriter.(*agentTraceWriter).wg.Wait()
+	assert.EqualValues(4, atomic.LoadInt64(&tracer.spansBuffered))
+
+	tracer.pushTrace(newTrace())
+	assert.Len(tracer.out, 2)
+	assert.EqualValues(1, atomic.LoadUint32(&tracer.tracesShed))
+}
+
+func TestReadFlushStats(t *testing.T) {
+	assert := assert.New(t)
+	tracer, _, flush, stop := startTestTracer(t)
+	defer stop()
+
+	for i := 0; i < 3; i++ {
+		root := tracer.StartSpan("web.request")
+		tracer.StartSpan("db.query", ChildOf(root.Context())).Finish()
+		root.Finish()
+	}
+	flush(3)
+	s := ReadFlushStats()
+	// the traces may have been sent in several payloads
+	assert.True(s.Flushes >= 1)
+	assert.InDelta(6.0, s.AvgSpans*float64(s.Flushes), 0.001)
+	assert.True(s.MinSpans >= 2 && s.MinSpans <= s.MaxSpans && s.MaxSpans <= 6)
+	assert.True(s.MinDuration > 0)
+	assert.True(s.MinDuration <= s.AvgDuration && s.AvgDuration <= s.MaxDuration)
+	assert.True(s.MaxQueued >= 1)
+
+	assert.Equal(FlushStats{}, ReadFlushStats())
+	stop()
+	assert.Equal(FlushStats{}, ReadFlushStats())
+}
+
+func TestPeekFlushStats(t *testing.T) {
+	assert := assert.New(t)
+	tracer, _, flush, stop := startTestTracer(t)
+	defer stop()
+
+	tracer.StartSpan("web.request").Finish()
+	flush(1)
+	s := PeekFlushStats()
+	assert.True(s.Flushes >= 1)
+	assert.True(s.MaxQueued >= 1)
+	assert.Equal(s, PeekFlushStats(), "peeking must not reset the statistics")
+
+	ResetFlushStats()
+	assert.Equal(FlushStats{}, PeekFlushStats())
+	stop()
+	assert.Equal(FlushStats{}, PeekFlushStats())
+}
+
 func TestTracerFlush(t *testing.T) {
 	// https://github.com/DataDog/dd-trace-go/issues/377
 	tracer, transport, flush, stop := startTestTracer(t)
@@ -1370,6 +2151,26 @@ func TestTracerReportsHostname(t *testing.T) {
 		assert.Equal(got, hostname)
 	})
 
+	t.Run("WithHostname/empty", func(t *testing.T) {
+		os.Setenv("DD_TRACE_REPORT_HOSTNAME", "true")
+		defer os.Unsetenv("DD_TRACE_REPORT_HOSTNAME")
+
+		tracer, _, _, stop := startTestTracer(t, WithHostname(""))
+		defer stop()
+
+		root := tracer.StartSpan("root").(*span)
+		child := tracer.StartSpan("child", ChildOf(root.Context())).(*span)
+		child.Finish()
+		root.Finish()
+
+		assert := assert.New(t)
+
+		_, ok := root.Meta[keyHostname]
+		assert.False(ok)
+		_, ok = child.Meta[keyHostname]
+		assert.False(ok)
+	})
+
 	t.Run("DD_TRACE_SOURCE_HOSTNAME/set", func(t *testing.T) {
 		os.Setenv("DD_TRACE_SOURCE_HOSTNAME", "hostname-test")
 		defer os.Unsetenv("DD_TRACE_SOURCE_HOSTNAME")
@@ -1533,6 +2334,171 @@ func BenchmarkStartSpan(b *testing.B) {
 	}
 }
 
+func BenchmarkStartSpanDisabled(b *testing.B) {
+	internal.SetGlobalTracer(&internal.NoopTracer{})
+	ctx := context.Background()
+
+	b.Run("StartSpan", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			s := StartSpan("op")
+			s.SetTag("key", "value")
+			s.Finish()
+		}
+	})
+
+	b.Run("StartSpanFromContext", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			s, _ := StartSpanFromContext(ctx, "op")
+			s.Finish()
+		}
+	})
+}
+
+func BenchmarkSpanPooling(b *testing.B) {
+	for name, enabled := range map[string]bool{"disabled": false, "enabled": true} {
+		b.Run(name, func(b *testing.B) {
+			tracer, _, _, stop := startTestTracer(b, WithSpanPooling(enabled))
+			defer stop()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				root := tracer.StartSpan("pylons.request", ResourceName("/"))
+				root.SetTag("http.method", "GET")
+				child := tracer.StartSpan("db.query", ChildOf(root.Context()))
+				child.SetTag("db.rows", 3)
+				child.Finish()
+				root.Finish()
+			}
+		})
+	}
+}
+
+func TestTracerResourceObfuscator(t *testing.T) {
+	trc, transport, flush, stop := startTestTracer(t, WithResourceObfuscator(ObfuscateURL))
+	defer stop()
+	root := trc.StartSpan("http.request", ResourceName("GET /users/1?token=secret"))
+	child := trc.StartSpan("http.request", ChildOf(root.Context()))
+	child.SetTag(ext.ResourceName, "GET /users/2")
+	child.Finish()
+	root.Finish()
+	flush(1)
+
+	traces := transport.Traces()
+	assert.Len(t, traces[0], 2)
+	for _, s := range traces[0] {
+		assert.Equal(t, "GET /users/?", s.Resource)
+	}
+}
+
+func TestSetServiceEnabled(t *testing.T) {
+	assert := assert.New(t)
+	trc, transport, flush, stop := startTestTracer(t)
+	defer stop()
+
+	SetServiceEnabled("noisy", false)
+	SetServiceEnabled("noisy", false)
+	root := trc.StartSpan("web.request", ServiceName("noisy"))
+	trc.StartSpan("db.query", ChildOf(root.Context()), ServiceName("db")).Finish()
+	root.Finish()
+	trc.StartSpan("web.request", ServiceName("quiet")).Finish()
+	flush(1)
+	assert.Equal("quiet", transport.Traces()[0][0].Service)
+	assert.EqualValues(2, atomic.LoadUint32(&trc.spansServiceDisabled))
+
+	transport.Reset()
+	SetServiceEnabled("noisy", true)
+	assert.False(trc.serviceDisabled("noisy"))
+	trc.StartSpan("web.request", ServiceName("noisy")).Finish()
+	flush(1)
+	assert.Equal("noisy", transport.Traces()[0][0].Service)
+}
+
+func TestSetIgnoreResources(t *testing.T) {
+	assert := assert.New(t)
+	trc, transport, flush, stop := startTestTracer(t)
+	defer stop()
+
+	assert.Error(SetIgnoreResources([]string{"GET /health", "("}))
+	assert.False(trc.resourceIgnored("GET /health"), "no pattern must be set on error")
+
+	assert.NoError(SetIgnoreResources([]string{"^GET /(health|ready)$"}))
+	root := trc.StartSpan("http.request", ResourceName("GET /health"))
+	trc.StartSpan("db.query", ChildOf(root.Context())).Finish()
+	root.Finish()
+	trc.StartSpan("http.request", ResourceName("GET /users")).Finish()
+	flush(1)
+	assert.Equal("GET /users", transport.Traces()[0][0].Resource)
+	assert.EqualValues(1, atomic.LoadUint32(&trc.tracesIgnored))
+
+	transport.Reset()
+	assert.NoError(SetIgnoreResources(nil))
+	trc.StartSpan("http.request", ResourceName("GET /health")).Finish()
+	flush(1)
+	assert.Equal("GET /health", transport.Traces()[0][0].Resource)
+}
+
+func TestTracerCaptureCaller(t *testing.T) {
+	callSite := func() string {
+		_, file, line, _ := runtime.Caller(1)
+		return fmt.Sprintf("%s:%d", file, line+1)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		trc, _, _, stop := startTestTracer(t)
+		defer stop()
+		sp := trc.StartSpan("op").(*span)
+		assert.NotContains(t, sp.Meta, keyCaller)
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		_, _, _, stop := startTestTracer(t, WithCaptureCaller(true))
+		defer stop()
+
+		want := callSite()
+		sp := StartSpan("op")
+		assert.Equal(t, want, sp.(*span).Meta[keyCaller])
+
+		want = callSite()
+		_, ctx := StartSpanFromContext(context.Background(), "op")
+		sp, _ = SpanFromContext(ctx)
+		assert.Equal(t, want, sp.(*span).Meta[keyCaller])
+
+		want = callSite()
+		sp = StartChild(sp, "op")
+		assert.Equal(t, want, sp.(*span).Meta[keyCaller])
+	})
+}
+
+func BenchmarkServiceDisabled(b *testing.B) {
+	trc := newUnstartedTracer()
+	trc.setServiceEnabled("noisy", false)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			trc.serviceDisabled("web")
+		}
+	})
+}
+
+func TestTracerWithoutWorker(t *testing.T) {
+	trc, transport, _, stop := startTestTracer(t, WithoutWorker())
+	trc.StartSpan("first").Finish()
+	assert.Len(t, trc.out, 1)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 0, transport.Len(), "traces must not be flushed automatically")
+
+	Flush()
+	assert.Len(t, trc.out, 0)
+	assert.Equal(t, 1, transport.Len())
+
+	trc.StartSpan("second").Finish()
+	stop()
+	assert.Equal(t, 2, transport.Len(), "Stop must flush the remaining traces")
+}
+
 // startTestTracer returns a Tracer with a DummyTransport
 func startTestTracer(t interface {
 	// support both *testing.T and *testing.B
@@ -1603,7 +2569,7 @@ func (t *dummyTransport) Stats() []*statsPayload {
 	return t.stats
 }
 
-func (t *dummyTransport) send(p *payload) (io.ReadCloser, error) {
+func (t *dummyTransport) send(_ context.Context, p *payload) (io.ReadCloser, error) {
 	traces, err := decode(p)
 	if err != nil {
 		return nil, err
@@ -7,6 +7,7 @@ package tracer
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -20,6 +21,7 @@ import (
 
 	traceinternal "gopkg.in/DataDog/dd-trace-go.v1/ddtrace/internal"
 	"gopkg.in/DataDog/dd-trace-go.v1/internal"
+	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/version"
 
 	"github.com/tinylib/msgp/msgp"
@@ -45,6 +47,7 @@ var defaultClient = &http.Client{
 		Proxy:                 http.ProxyFromEnvironment,
 		DialContext:           defaultDialer.DialContext,
 		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   100, // all connections go to the agent
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
@@ -62,9 +65,9 @@ const (
 
 // transport is an interface for communicating data to the agent.
 type transport interface {
-	// send sends the payload p to the agent using the transport set up.
-	// It returns a non-nil response body when no error occurred.
-	send(p *payload) (body io.ReadCloser, err error)
+	// send sends the payload p to the agent using the transport set up, giving
+	// up when ctx is done. It returns a non-nil response body when no error occurred.
+	send(ctx context.Context, p *payload) (body io.ReadCloser, err error)
 	// sendStats sends the given stats payload to the agent.
 	sendStats(s *statsPayload) error
 	// endpoint returns the URL to which the transport will send traces.
@@ -72,10 +75,25 @@ type transport interface {
 }
 
 type httpTransport struct {
-	traceURL string            // the delivery URL for traces
-	statsURL string            // the delivery URL for stats
-	client   *http.Client      // the HTTP client used in the POST
-	headers  map[string]string // the Transport headers
+	traceURL       string            // the delivery URL for traces
+	legacyTraceURL string            // the delivery URL for traces on agents not supporting traceURL
+	statsURL       string            // the delivery URL for stats
+	client         *http.Client      // the HTTP client used in the POST
+	headers        map[string]string // the Transport headers
+
+	// setHeaders, when set, sets the headers provided by the user on every
+	// request, see WithHTTPHeaders and WithHTTPHeadersFunc.
+	setHeaders func(req *http.Request)
+
+	// legacy is set to 1 (atomically) once the agent is known to only support
+	// legacyTraceURL. The v0.3 endpoint accepts the same payload, but does not
+	// respond with sampling rates.
+	legacy uint32
+
+	// clockOffset holds, in nanoseconds, how far ahead of the local clock the
+	// agent's clock is, as measured from the Date header of its responses. It is
+	// zero while the difference is below clockSkewThreshold.
+	clockOffset int64
 }
 
 // newTransport returns a new Transport implementation that sends traces to a
@@ -101,10 +119,19 @@ func newHTTPTransport(addr string, client *http.Client) *httpTransport {
 		defaultHeaders["Datadog-Container-ID"] = cid
 	}
 	return &httpTransport{
-		traceURL: fmt.Sprintf("http://%s/v0.4/traces", addr),
-		statsURL: fmt.Sprintf("http://%s/v0.6/stats", addr),
-		client:   client,
-		headers:  defaultHeaders,
+		traceURL:       fmt.Sprintf("http://%s/v0.4/traces", addr),
+		legacyTraceURL: fmt.Sprintf("http://%s/v0.3/traces", addr),
+		statsURL:       fmt.Sprintf("http://%s/v0.6/stats", addr),
+		client:         client,
+		headers:        defaultHeaders,
+	}
+}
+
+// useLegacyEndpoint switches the transport to sending traces to the v0.3 endpoint,
+// for agents which do not support v0.4.
+func (t *httpTransport) useLegacyEndpoint() {
+	if atomic.CompareAndSwapUint32(&t.legacy, 0, 1) {
+		log.Warn("Agent does not support %s, sending traces to %s", t.traceURL, t.legacyTraceURL)
 	}
 }
 
@@ -117,16 +144,19 @@ func (t *httpTransport) sendStats(p *statsPayload) error {
 	if err != nil {
 		return err
 	}
+	if t.setHeaders != nil {
+		t.setHeaders(req)
+	}
 	resp, err := t.client.Do(req)
 	if err != nil {
 		return err
 	}
+	defer closeBody(resp.Body)
 	if code := resp.StatusCode; code >= 400 {
 		// error, check the body for context information and
 		// return a nice error.
 		msg := make([]byte, 1000)
 		n, _ := resp.Body.Read(msg)
-		resp.Body.Close()
 		txt := http.StatusText(code)
 		if n > 0 {
 			return fmt.Errorf("%s (Status: %s)", msg[:n], txt)
@@ -136,14 +166,43 @@ func (t *httpTransport) sendStats(p *statsPayload) error {
 	return nil
 }
 
-func (t *httpTransport) send(p *payload) (body io.ReadCloser, err error) {
-	req, err := http.NewRequest("POST", t.traceURL, p)
+// clockSkewThreshold is the smallest difference between the local and agent clocks
+// which is corrected when clock sync is enabled. The Date header has a precision of
+// one second, so smaller differences can not be measured reliably.
+const clockSkewThreshold = 2 * time.Second
+
+// recordAgentClock updates the offset of the agent's clock from the Date header of
+// one of its responses, received at the local time now.
+func (t *httpTransport) recordAgentClock(date string, now time.Time) {
+	d, err := http.ParseTime(date)
+	if err != nil {
+		return
+	}
+	// the header is truncated to the second
+	offset := d.Add(time.Second / 2).Sub(now)
+	if offset > -clockSkewThreshold && offset < clockSkewThreshold {
+		offset = 0
+	}
+	atomic.StoreInt64(&t.clockOffset, int64(offset))
+}
+
+// agentClockOffset returns how far ahead of the local clock the agent's clock is.
+func (t *httpTransport) agentClockOffset() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.clockOffset))
+}
+
+func (t *httpTransport) send(ctx context.Context, p *payload) (body io.ReadCloser, err error) {
+	legacy := atomic.LoadUint32(&t.legacy) == 1
+	req, err := http.NewRequestWithContext(ctx, "POST", t.endpoint(), p)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create http request: %v", err)
 	}
 	for header, value := range t.headers {
 		req.Header.Set(header, value)
 	}
+	if t.setHeaders != nil {
+		t.setHeaders(req)
+	}
 	req.Header.Set(traceCountHeader, strconv.Itoa(p.itemCount()))
 	req.Header.Set("Content-Length", strconv.Itoa(p.size()))
 	req.Header.Set(headerComputedTopLevel, "yes")
@@ -166,22 +225,48 @@ func (t *httpTransport) send(p *payload) (body io.ReadCloser, err error) {
 	if err != nil {
 		return nil, err
 	}
+	t.recordAgentClock(response.Header.Get("Date"), time.Now())
+	if response.StatusCode == http.StatusNotFound && !legacy {
+		// the agent predates the v0.4 endpoint; the payload can not be sent
+		// again, but the next ones will go to the v0.3 endpoint
+		t.useLegacyEndpoint()
+	}
+	if code := response.StatusCode; code == http.StatusUnauthorized || code == http.StatusForbidden {
+		// retrying won't help until the credentials are fixed
+		closeBody(response.Body)
+		return nil, fmt.Errorf("%s: the request was rejected; check the credentials set using WithHTTPHeaders or WithHTTPHeadersFunc", http.StatusText(code))
+	}
 	if code := response.StatusCode; code >= 400 {
 		// error, check the body for context information and
 		// return a nice error.
 		msg := make([]byte, 1000)
 		n, _ := response.Body.Read(msg)
-		response.Body.Close()
+		closeBody(response.Body)
 		txt := http.StatusText(code)
 		if n > 0 {
 			return nil, fmt.Errorf("%s (Status: %s)", msg[:n], txt)
 		}
 		return nil, fmt.Errorf("%s", txt)
 	}
+	if legacy {
+		// the v0.3 endpoint does not respond with sampling rates
+		closeBody(response.Body)
+		return http.NoBody, nil
+	}
 	return response.Body, nil
 }
 
+// closeBody reads the remainder of the response body and closes it, allowing the
+// underlying connection to be reused for subsequent requests.
+func closeBody(body io.ReadCloser) {
+	io.Copy(io.Discard, body)
+	body.Close()
+}
+
 func (t *httpTransport) endpoint() string {
+	if atomic.LoadUint32(&t.legacy) == 1 {
+		return t.legacyTraceURL
+	}
 	return t.traceURL
 }
 
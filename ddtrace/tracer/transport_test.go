@@ -6,6 +6,7 @@
 package tracer
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -16,7 +17,10 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -72,7 +76,7 @@ func TestTracesAgentIntegration(t *testing.T) {
 		transport := newHTTPTransport(defaultAddress, defaultClient)
 		p, err := encode(tc.payload)
 		assert.NoError(err)
-		_, err = transport.send(p)
+		_, err = transport.send(context.Background(), p)
 		assert.NoError(err)
 	}
 }
@@ -137,7 +141,7 @@ func TestTransportResponse(t *testing.T) {
 			defer ln.Close()
 			addr := ln.Addr().String()
 			transport := newHTTPTransport(addr, defaultClient)
-			rc, err := transport.send(newPayload())
+			rc, err := transport.send(context.Background(), newPayload())
 			if tt.err != "" {
 				assert.Equal(tt.err, err.Error())
 				return
@@ -151,6 +155,127 @@ func TestTransportResponse(t *testing.T) {
 	}
 }
 
+func TestTransportLegacyEndpoint(t *testing.T) {
+	assert := assert.New(t)
+	var hits []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.URL.Path)
+		if r.URL.Path != "/v0.3/traces" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer srv.Close()
+	transport := newHTTPTransport(strings.TrimPrefix(srv.URL, "http://"), defaultClient)
+
+	// the agent does not know v0.4; the first payload is lost
+	_, err := transport.send(context.Background(), newPayload())
+	assert.Error(err)
+	assert.Equal(srv.URL+"/v0.3/traces", transport.endpoint())
+
+	rc, err := transport.send(context.Background(), newPayload())
+	assert.NoError(err)
+	// no sampling rates are read from the v0.3 endpoint
+	assert.NoError(newPrioritySampler().readRatesJSON(rc))
+	assert.Equal([]string{"/v0.4/traces", "/v0.3/traces"}, hits)
+}
+
+func TestTransportSendDeadline(t *testing.T) {
+	assert := assert.New(t)
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a hung agent
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+	// the client itself has no timeout
+	transport := newHTTPTransport(strings.TrimPrefix(srv.URL, "http://"), &http.Client{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := transport.send(ctx, newPayload())
+	assert.ErrorIs(err, context.DeadlineExceeded)
+	assert.Less(time.Since(start), time.Second)
+}
+
+func TestTransportAgentClockOffset(t *testing.T) {
+	assert := assert.New(t)
+	var skew time.Duration
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(skew).UTC().Format(http.TimeFormat))
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	transport := newHTTPTransport(strings.TrimPrefix(srv.URL, "http://"), defaultClient)
+
+	_, err := transport.send(context.Background(), newPayload())
+	assert.NoError(err)
+	assert.Zero(transport.agentClockOffset())
+
+	skew = time.Hour
+	_, err = transport.send(context.Background(), newPayload())
+	assert.NoError(err)
+	assert.InDelta(time.Hour, transport.agentClockOffset(), float64(time.Second))
+
+	skew = -time.Hour
+	_, err = transport.send(context.Background(), newPayload())
+	assert.NoError(err)
+	assert.InDelta(-time.Hour, transport.agentClockOffset(), float64(time.Second))
+
+	// small differences can not be measured reliably
+	transport.recordAgentClock(time.Now().UTC().Format(http.TimeFormat), time.Now().Add(time.Second))
+	assert.Zero(transport.agentClockOffset())
+	transport.recordAgentClock("invalid", time.Now())
+	assert.Zero(transport.agentClockOffset())
+}
+
+func TestTransportCustomHeaders(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		mu      sync.Mutex
+		headers []http.Header
+		status  = http.StatusOK
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		headers = append(headers, r.Header)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	var token int32
+	c := newConfig(
+		WithAgentAddr(strings.TrimPrefix(srv.URL, "http://")),
+		WithHTTPHeaders(map[string]string{"X-Proxy-Key": "secret"}),
+		WithHTTPHeaders(map[string]string{"X-Team": "core"}),
+		WithHTTPHeadersFunc(func() map[string]string {
+			return map[string]string{"Authorization": "Bearer " + strconv.Itoa(int(atomic.AddInt32(&token, 1)))}
+		}),
+	)
+
+	_, err := c.transport.send(context.Background(), newPayload())
+	assert.NoError(err)
+	assert.NoError(c.transport.sendStats(&statsPayload{}))
+	assert.NoError(pingAgent(c))
+	// the agent's features were loaded by newConfig
+	assert.Len(headers, 4)
+	for i, h := range headers {
+		assert.Equal("secret", h.Get("X-Proxy-Key"))
+		assert.Equal("core", h.Get("X-Team"))
+		assert.Equal("Bearer "+strconv.Itoa(i+1), h.Get("Authorization"))
+	}
+	assert.Equal("go", headers[1].Get("Datadog-Meta-Lang"))
+
+	for _, code := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		status = code
+		_, err = c.transport.send(context.Background(), newPayload())
+		assert.EqualError(err, http.StatusText(code)+": the request was rejected; check the credentials set using WithHTTPHeaders or WithHTTPHeadersFunc")
+	}
+}
+
 func TestTraceCountHeader(t *testing.T) {
 	assert := assert.New(t)
 
@@ -179,7 +304,7 @@ func TestTraceCountHeader(t *testing.T) {
 		transport := newHTTPTransport(strings.TrimPrefix(srv.URL, "http://"), defaultClient)
 		p, err := encode(tc.payload)
 		assert.NoError(err)
-		_, err = transport.send(p)
+		_, err = transport.send(context.Background(), p)
 		assert.NoError(err)
 	}
 	assert.Equal(hits, len(testCases))
@@ -214,7 +339,7 @@ func TestCustomTransport(t *testing.T) {
 	})
 	p, err := encode(getTestTrace(1, 1))
 	assert.NoError(err)
-	_, err = transport.send(p)
+	_, err = transport.send(context.Background(), p)
 	assert.NoError(err)
 
 	// make sure our custom round tripper was used
@@ -240,7 +365,7 @@ func TestWithHTTPClient(t *testing.T) {
 
 	p, err := encode(getTestTrace(1, 1))
 	assert.NoError(err)
-	_, err = trc.config.transport.send(p)
+	_, err = trc.config.transport.send(context.Background(), p)
 	assert.NoError(err)
 	assert.Len(rt.reqs, 2)
 	assert.Contains(rt.reqs[0].URL.Path, "/info")
@@ -277,8 +402,84 @@ func TestWithUDS(t *testing.T) {
 
 	p, err := encode(getTestTrace(1, 1))
 	assert.NoError(err)
-	_, err = trc.config.transport.send(p)
+	_, err = trc.config.transport.send(context.Background(), p)
 	assert.NoError(err)
 	assert.Len(rt.reqs, 2)
 	assert.Equal(hits, 2)
 }
+
+func TestWithConnectionPool(t *testing.T) {
+	assert := assert.New(t)
+	client := &http.Client{Transport: &http.Transport{MaxIdleConns: 3}, Timeout: time.Second}
+	c := newConfig(WithHTTPClient(client), WithConnectionPool(10, time.Minute))
+
+	tr, ok := c.httpClient.Transport.(*http.Transport)
+	assert.True(ok)
+	assert.Equal(10, tr.MaxIdleConns)
+	assert.Equal(10, tr.MaxIdleConnsPerHost)
+	assert.Equal(time.Minute, tr.IdleConnTimeout)
+	assert.Equal(time.Second, c.httpClient.Timeout)
+	// the given client is left untouched
+	assert.Equal(3, client.Transport.(*http.Transport).MaxIdleConns)
+}
+
+// newConnCountingServer returns a test agent which responds with sampling rates
+// and counts the number of connections opened to it.
+func newConnCountingServer() (srv *httptest.Server, conns *int32) {
+	conns = new(int32)
+	srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"rate_by_service":{"service:,env:":0.5}}`))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	srv.Start()
+	return srv, conns
+}
+
+func TestTransportConnectionReuse(t *testing.T) {
+	srv, conns := newConnCountingServer()
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	assert.NoError(t, err)
+	transport := newHTTPTransport(u.Host, defaultClient)
+	ps := newPrioritySampler()
+
+	for i := 0; i < 10; i++ {
+		p, err := encode(getTestTrace(1, 1))
+		assert.NoError(t, err)
+		rc, err := transport.send(context.Background(), p)
+		assert.NoError(t, err)
+		assert.NoError(t, ps.readRatesJSON(rc))
+		assert.NoError(t, transport.sendStats(&statsPayload{}))
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(conns))
+}
+
+func BenchmarkTransportConnectionReuse(b *testing.B) {
+	srv, conns := newConnCountingServer()
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	transport := newHTTPTransport(u.Host, defaultClient)
+	ps := newPrioritySampler()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p, err := encode(getTestTrace(1, 1))
+		if err != nil {
+			b.Fatal(err)
+		}
+		rc, err := transport.send(context.Background(), p)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ps.readRatesJSON(rc)
+	}
+	b.ReportMetric(float64(atomic.LoadInt32(conns)), "conns")
+}
@@ -7,9 +7,11 @@ package tracer
 
 import (
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
 
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/samplernames"
 )
 
@@ -122,3 +124,75 @@ func parsePropagatableTraceTags(s string) (map[string]string, error) {
 	tags[key] = s[start:]
 	return tags, nil
 }
+
+// setStructTags sets the fields of the struct v as tags on s, flattening nested
+// structs up to depth levels deep. See SetStructTags.
+func setStructTags(s ddtrace.Span, v reflect.Value, prefix string, depth int) {
+	v, ok := indirect(v)
+	if !ok || v.Kind() != reflect.Struct {
+		return
+	}
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		name, keepZero := f.Name, false
+		if tag, ok := f.Tag.Lookup("trace"); ok {
+			if tag == "-" {
+				continue
+			}
+			opts := strings.Split(tag, ",")
+			if opts[0] != "" {
+				name = opts[0]
+			}
+			for _, o := range opts[1:] {
+				keepZero = keepZero || o == "keepzero"
+			}
+		}
+		fv := v.Field(i)
+		if !keepZero && fv.IsZero() {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		fv, ok := indirect(fv)
+		if !ok {
+			continue
+		}
+		switch fv.Kind() {
+		case reflect.Bool:
+			s.SetTag(name, fv.Bool())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			s.SetTag(name, fv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			s.SetTag(name, fv.Uint())
+		case reflect.Float32, reflect.Float64:
+			s.SetTag(name, fv.Float())
+		case reflect.String:
+			s.SetTag(name, fv.String())
+		case reflect.Struct:
+			if str, ok := fv.Interface().(fmt.Stringer); ok {
+				s.SetTag(name, str.String())
+			} else if depth > 0 {
+				// the depth limit also guards against cyclic structures
+				setStructTags(s, fv, name, depth-1)
+			}
+		}
+	}
+}
+
+// indirect follows the pointers and interfaces in v, reporting false if it
+// encounters a nil one.
+func indirect(v reflect.Value) (reflect.Value, bool) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return v, false
+		}
+		v = v.Elem()
+	}
+	return v, v.IsValid()
+}
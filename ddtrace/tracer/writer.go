@@ -7,6 +7,7 @@ package tracer
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -14,6 +15,7 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
@@ -30,6 +32,108 @@ type traceWriter interface {
 	stop()
 }
 
+// FlushResult describes an attempt to send a payload of traces to the agent.
+type FlushResult struct {
+	// Traces specifies the number of traces in the payload.
+	Traces int
+
+	// Spans specifies the number of spans in the payload.
+	Spans int
+
+	// Bytes specifies the size of the encoded payload.
+	Bytes int
+
+	// Duration specifies how long sending the payload took.
+	Duration time.Duration
+
+	// Err holds the reason the payload was not sent, or nil if it was.
+	Err error
+}
+
+// FlushStats summarizes the payloads of traces sent to the agent over a period of
+// time. See ReadFlushStats.
+type FlushStats struct {
+	// Flushes specifies the number of payloads the tracer attempted to send.
+	Flushes int
+
+	// MinDuration, MaxDuration and AvgDuration describe how long sending a
+	// payload took.
+	MinDuration, MaxDuration, AvgDuration time.Duration
+
+	// MinSpans, MaxSpans and AvgSpans describe the number of spans per payload.
+	MinSpans, MaxSpans int
+	AvgSpans           float64
+
+	// MaxQueued specifies the largest number of finished traces which were
+	// waiting to be added to a payload at once.
+	MaxQueued int
+
+	// BufferedBytes specifies the size of the payload being filled with traces,
+	// at the time statistics were read. Traces are encoded as they are added to
+	// the payload, so this is its exact encoded size. A payload is sent once it
+	// reaches half the size accepted by the agent.
+	BufferedBytes int
+}
+
+// flushAggregator aggregates the results of sending payloads into FlushStats.
+type flushAggregator struct {
+	mu            sync.Mutex
+	stats         FlushStats
+	totalDuration time.Duration
+	totalSpans    int
+}
+
+// record adds the result of sending a payload to the statistics.
+func (a *flushAggregator) record(r FlushResult) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := &a.stats
+	if s.Flushes == 0 || r.Duration < s.MinDuration {
+		s.MinDuration = r.Duration
+	}
+	if r.Duration > s.MaxDuration {
+		s.MaxDuration = r.Duration
+	}
+	if s.Flushes == 0 || r.Spans < s.MinSpans {
+		s.MinSpans = r.Spans
+	}
+	if r.Spans > s.MaxSpans {
+		s.MaxSpans = r.Spans
+	}
+	s.Flushes++
+	a.totalDuration += r.Duration
+	a.totalSpans += r.Spans
+}
+
+// snapshot returns the statistics aggregated since they were last reset, along
+// with the largest queue length recorded in maxQueued if not nil, resetting both
+// when reset is true. Everything is read under the same lock, so that no payload
+// is counted in a snapshot but missing from the next, or counted twice.
+func (a *flushAggregator) snapshot(maxQueued *int64, reset bool) FlushStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.stats
+	if s.Flushes > 0 {
+		s.AvgDuration = a.totalDuration / time.Duration(s.Flushes)
+		s.AvgSpans = float64(a.totalSpans) / float64(s.Flushes)
+	}
+	if maxQueued != nil {
+		if reset {
+			s.MaxQueued = int(atomic.SwapInt64(maxQueued, 0))
+		} else {
+			s.MaxQueued = int(atomic.LoadInt64(maxQueued))
+		}
+	}
+	if reset {
+		a.stats, a.totalDuration, a.totalSpans = FlushStats{}, 0, 0
+	}
+	return s
+}
+
+// errCircuitOpen is reported when payloads are dropped because the agent has
+// been unreachable.
+var errCircuitOpen = errors.New("circuit breaker open: agent unreachable")
+
 type agentTraceWriter struct {
 	// config holds the tracer configuration
 	config *config
@@ -37,6 +141,9 @@ type agentTraceWriter struct {
 	// payload encodes and buffers traces in msgpack format
 	payload *payload
 
+	// spans holds the number of spans buffered in payload.
+	spans int
+
 	// climit limits the number of concurrent outgoing connections
 	climit chan struct{}
 
@@ -46,6 +153,25 @@ type agentTraceWriter struct {
 	// prioritySampling is the prioritySampler into which agentTraceWriter will
 	// read sampling rates sent by the agent
 	prioritySampling *prioritySampler
+
+	// breaker stops payloads from being sent while the agent is unreachable
+	breaker *circuitBreaker
+
+	// flushStats aggregates the results of the payloads sent, see ReadFlushStats.
+	flushStats flushAggregator
+
+	// release, when set, is called with the number of spans which are no longer
+	// held by the writer because they were sent or dropped.
+	release func(n int)
+
+	// bufferedBytes holds the size of payload. It is updated when traces are added
+	// and when the payload is sent, so that it can be read by other goroutines.
+	// Accessed atomically.
+	bufferedBytes int64
+
+	// lastSent holds the time, in Unix nanoseconds, at which a payload was last
+	// sent successfully, refreshing the sampling rates. Accessed atomically.
+	lastSent int64
 }
 
 func newAgentTraceWriter(c *config, s *prioritySampler) *agentTraceWriter {
@@ -54,6 +180,7 @@ func newAgentTraceWriter(c *config, s *prioritySampler) *agentTraceWriter {
 		payload:          newPayload(),
 		climit:           make(chan struct{}, concurrentConnectionLimit),
 		prioritySampling: s,
+		breaker:          newCircuitBreaker(breakerFailureThreshold, breakerCooldown),
 	}
 }
 
@@ -61,10 +188,20 @@ func (h *agentTraceWriter) add(trace []*span) {
 	if err := h.payload.push(trace); err != nil {
 		h.config.statsd.Incr("datadog.tracer.traces_dropped", []string{"reason:encoding_error"}, 1)
 		log.Error("Error encoding msgpack: %v", err)
+		h.releaseSpans(len(trace))
+	} else {
+		h.spans += len(trace)
 	}
-	if h.payload.size() > payloadSizeLimit {
+	size := h.payload.size()
+	atomic.StoreInt64(&h.bufferedBytes, int64(size))
+	if size > payloadSizeLimit {
 		h.config.statsd.Incr("datadog.tracer.flush_triggered", []string{"reason:size"}, 1)
 		h.flush()
+		return
+	}
+	if n := h.config.flushHighWatermark; n > 0 && h.spans >= n {
+		h.config.statsd.Incr("datadog.tracer.flush_triggered", []string{"reason:watermark"}, 1)
+		h.flush()
 	}
 }
 
@@ -79,25 +216,54 @@ func (h *agentTraceWriter) flush() {
 	if h.payload.itemCount() == 0 {
 		return
 	}
+	if !h.breaker.allow() {
+		// the agent has been failing; drop the payload instead of waiting on it
+		count := h.payload.itemCount()
+		h.report(FlushResult{Traces: count, Spans: h.spans, Bytes: h.payload.size(), Err: errCircuitOpen})
+		h.releaseSpans(h.spans)
+		h.payload = newPayload()
+		atomic.StoreInt64(&h.bufferedBytes, 0)
+		h.spans = 0
+		h.config.statsd.Count("datadog.tracer.traces_dropped", int64(count), []string{"reason:circuit_open"}, 1)
+		log.Debug("Circuit breaker open, dropping %d traces", count)
+		return
+	}
 	h.wg.Add(1)
 	h.climit <- struct{}{}
-	oldp := h.payload
+	oldp, spans := h.payload, h.spans
 	h.payload = newPayload()
+	h.spans = 0
+	atomic.StoreInt64(&h.bufferedBytes, 0)
 	go func(p *payload) {
+		size, count := p.size(), p.itemCount()
+		var err error
 		defer func(start time.Time) {
+			took := time.Since(start)
+			h.config.statsd.Timing("datadog.tracer.flush_duration", took, nil, 1)
+			r := FlushResult{Traces: count, Spans: spans, Bytes: size, Duration: took, Err: err}
+			h.flushStats.record(r)
+			h.report(r)
+			h.releaseSpans(spans)
 			<-h.climit
 			h.wg.Done()
-			h.config.statsd.Timing("datadog.tracer.flush_duration", time.Since(start), nil, 1)
 		}(time.Now())
-		size, count := p.size(), p.itemCount()
 		log.Debug("Sending payload: size: %d traces: %d\n", size, count)
-		rc, err := h.config.transport.send(p)
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		defer cancel()
+		var rc io.ReadCloser
+		rc, err = h.config.transport.send(ctx, p)
 		if err != nil {
 			h.config.statsd.Count("datadog.tracer.traces_dropped", int64(count), []string{"reason:send_failed"}, 1)
 			log.Error("lost %d traces: %v", count, err)
+			if h.breaker.failure() {
+				h.config.statsd.Incr("datadog.tracer.circuit_breaker.opened", nil, 1)
+				log.Warn("Agent unreachable, dropping traces for the next %s", h.breaker.cooldown)
+			}
 		} else {
+			h.breaker.success()
 			h.config.statsd.Count("datadog.tracer.flush_bytes", int64(size), nil, 1)
 			h.config.statsd.Count("datadog.tracer.flush_traces", int64(count), nil, 1)
+			atomic.StoreInt64(&h.lastSent, now())
 			if err := h.prioritySampling.readRatesJSON(rc); err != nil {
 				h.config.statsd.Incr("datadog.tracer.decode_error", nil, 1)
 			}
@@ -105,6 +271,50 @@ func (h *agentTraceWriter) flush() {
 	}(oldp)
 }
 
+// pollRates refreshes the sampling rates by sending an empty payload to the agent,
+// which responds with the rates as it does for any payload. Nothing is sent if a
+// payload was sent within the given interval, since the rates are fresh already,
+// or while the agent is unreachable.
+func (h *agentTraceWriter) pollRates(interval time.Duration) {
+	if now()-atomic.LoadInt64(&h.lastSent) < int64(interval) || h.breaker.isOpen() {
+		return
+	}
+	p := newPayload()
+	p.updateHeader()
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	rc, err := h.config.transport.send(ctx, p)
+	if err != nil {
+		log.Debug("Failed to poll the agent's sampling rates: %v", err)
+		return
+	}
+	atomic.StoreInt64(&h.lastSent, now())
+	if err := h.prioritySampling.readRatesJSON(rc); err != nil {
+		h.config.statsd.Incr("datadog.tracer.decode_error", nil, 1)
+	}
+}
+
+// releaseSpans reports that n spans are no longer held by the writer.
+func (h *agentTraceWriter) releaseSpans(n int) {
+	if h.release != nil {
+		h.release(n)
+	}
+}
+
+// report calls the flush callback, if any, with the result r.
+func (h *agentTraceWriter) report(r FlushResult) {
+	fn := h.config.flushCallback
+	if fn == nil {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("Flush callback panicked: %v", err)
+		}
+	}()
+	fn(r)
+}
+
 // logWriter specifies the output target of the logTraceWriter; replaced in tests.
 var logWriter io.Writer = os.Stdout
 
@@ -123,6 +333,9 @@ func newLogTraceWriter(c *config) *logTraceWriter {
 		config: c,
 		w:      logWriter,
 	}
+	if c.traceOutput != nil {
+		w.w = c.traceOutput
+	}
 	w.resetBuffer()
 	return w
 }
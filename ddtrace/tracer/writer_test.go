@@ -8,12 +8,20 @@ package tracer
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
 )
@@ -91,6 +99,27 @@ func TestEncodeFloat(t *testing.T) {
 
 }
 
+func TestFlushAggregator(t *testing.T) {
+	assert := assert.New(t)
+	var a flushAggregator
+	assert.Equal(FlushStats{}, a.snapshot(nil, true))
+	a.record(FlushResult{Spans: 10, Duration: 30 * time.Millisecond})
+	a.record(FlushResult{Spans: 2, Duration: 10 * time.Millisecond})
+	a.record(FlushResult{Spans: 3, Duration: 20 * time.Millisecond, Err: errors.New("fail")})
+	assert.Equal(FlushStats{
+		Flushes:     3,
+		MinDuration: 10 * time.Millisecond,
+		MaxDuration: 30 * time.Millisecond,
+		AvgDuration: 20 * time.Millisecond,
+		MinSpans:    2,
+		MaxSpans:    10,
+		AvgSpans:    5,
+	}, a.snapshot(nil, false))
+	// peeking keeps the statistics, reading resets them
+	assert.Equal(3, a.snapshot(nil, true).Flushes)
+	assert.Equal(FlushStats{}, a.snapshot(nil, true))
+}
+
 func TestLogWriter(t *testing.T) {
 	t.Run("basic", func(t *testing.T) {
 		assert := assert.New(t)
@@ -114,6 +143,28 @@ func TestLogWriter(t *testing.T) {
 		assert.Equal(io.EOF, err)
 	})
 
+	t.Run("output", func(t *testing.T) {
+		assert := assert.New(t)
+		var buf bytes.Buffer
+		Start(WithTraceOutput(&buf))
+		StartSpan("op").Finish()
+		Stop()
+		v := struct{ Traces [][]map[string]interface{} }{}
+		assert.NoError(json.NewDecoder(&buf).Decode(&v))
+		assert.Len(v.Traces, 1)
+		assert.Equal("op", v.Traces[0][0]["name"])
+	})
+
+	t.Run("env", func(t *testing.T) {
+		os.Setenv("DD_TRACE_TO_STDOUT", "true")
+		defer os.Unsetenv("DD_TRACE_TO_STDOUT")
+		c := newConfig()
+		assert.True(t, c.logToStdout)
+		assert.Zero(t, c.agent)
+		_, ok := newUnstartedTracer().traceWriter.(*logTraceWriter)
+		assert.True(t, ok)
+	})
+
 	t.Run("inf+nan", func(t *testing.T) {
 		assert := assert.New(t)
 		var buf bytes.Buffer
@@ -313,3 +364,128 @@ func BenchmarkJsonEncodeFloat(b *testing.B) {
 		encodeFloat(bs, float64(1e-9))
 	}
 }
+
+func TestAgentWriterBufferedBytes(t *testing.T) {
+	assert := assert.New(t)
+	c := newConfig(withTransport(newDummyTransport()), withNoopStats())
+	h := newAgentTraceWriter(c, newPrioritySampler())
+	h.add([]*span{makeSpan(10)})
+	size := h.payload.size()
+	assert.True(size > 0)
+	assert.EqualValues(size, atomic.LoadInt64(&h.bufferedBytes))
+
+	h.add([]*span{makeSpan(10)})
+	assert.EqualValues(h.payload.size(), atomic.LoadInt64(&h.bufferedBytes))
+	assert.True(h.payload.size() > size)
+
+	h.flush()
+	h.wg.Wait()
+	assert.EqualValues(0, atomic.LoadInt64(&h.bufferedBytes))
+}
+
+func TestAgentWriterPollRates(t *testing.T) {
+	assert := assert.New(t)
+	var polls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var traces spanLists
+		if err := msgp.Decode(r.Body, &traces); err != nil || len(traces) != 0 {
+			t.Errorf("expected an empty payload, got %v (%v)", traces, err)
+		}
+		atomic.AddInt32(&polls, 1)
+		w.Write([]byte(`{"rate_by_service":{"service:,env:":0.25}}`))
+	}))
+	defer srv.Close()
+	c := newConfig(withTransport(newHTTPTransport(srv.Listener.Addr().String(), defaultClient)), withNoopStats())
+	ps := newPrioritySampler()
+	h := newAgentTraceWriter(c, ps)
+
+	h.pollRates(time.Minute)
+	assert.EqualValues(1, atomic.LoadInt32(&polls))
+	ps.mu.RLock()
+	assert.Equal(0.25, ps.defaultRate)
+	ps.mu.RUnlock()
+
+	// the rates are fresh
+	h.pollRates(time.Minute)
+	assert.EqualValues(1, atomic.LoadInt32(&polls))
+
+	// the agent is unreachable
+	atomic.StoreInt64(&h.lastSent, 0)
+	for i := 0; i < breakerFailureThreshold; i++ {
+		h.breaker.failure()
+	}
+	h.pollRates(time.Minute)
+	assert.EqualValues(1, atomic.LoadInt32(&polls))
+}
+
+func TestAgentWriterFlushHighWatermark(t *testing.T) {
+	assert := assert.New(t)
+	transport := newDummyTransport()
+	c := newConfig(withTransport(transport), withNoopStats(), WithFlushHighWatermark(3))
+	h := newAgentTraceWriter(c, newPrioritySampler())
+
+	h.add([]*span{makeSpan(0), makeSpan(0)})
+	assert.Equal(1, h.payload.itemCount())
+	assert.Equal(2, h.spans)
+
+	h.add([]*span{makeSpan(0)})
+	assert.Equal(0, h.payload.itemCount())
+	assert.Equal(0, h.spans)
+	h.wg.Wait()
+	assert.Equal(2, transport.Len())
+}
+
+func TestAgentWriterFlushCallback(t *testing.T) {
+	t.Run("sent", func(t *testing.T) {
+		assert := assert.New(t)
+		var results []FlushResult
+		c := newConfig(withTransport(newDummyTransport()), withNoopStats(), WithFlushCallback(func(r FlushResult) {
+			results = append(results, r)
+		}))
+		h := newAgentTraceWriter(c, newPrioritySampler())
+		h.add([]*span{makeSpan(0), makeSpan(0)})
+		h.add([]*span{makeSpan(0)})
+		h.flush()
+		h.wg.Wait()
+
+		assert.Len(results, 1)
+		assert.Equal(2, results[0].Traces)
+		assert.Equal(3, results[0].Spans)
+		assert.Greater(results[0].Bytes, 0)
+		assert.NoError(results[0].Err)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		assert := assert.New(t)
+		var results []FlushResult
+		c := newConfig(withTransport(&failingTransport{}), withNoopStats(), WithFlushCallback(func(r FlushResult) {
+			results = append(results, r)
+		}))
+		h := newAgentTraceWriter(c, newPrioritySampler())
+		for i := 0; i < breakerFailureThreshold+1; i++ {
+			h.add([]*span{makeSpan(0)})
+			h.flush()
+			h.wg.Wait()
+		}
+
+		assert.Len(results, breakerFailureThreshold+1)
+		assert.EqualError(results[0].Err, "agent unreachable")
+		assert.Equal(errCircuitOpen, results[breakerFailureThreshold].Err)
+		assert.Equal(1, results[breakerFailureThreshold].Traces)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		assert := assert.New(t)
+		tp := new(testLogger)
+		defer log.UseLogger(tp)()
+		c := newConfig(withTransport(newDummyTransport()), withNoopStats(), WithFlushCallback(func(FlushResult) {
+			panic("oops")
+		}))
+		h := newAgentTraceWriter(c, newPrioritySampler())
+		h.add([]*span{makeSpan(0)})
+		h.flush()
+		h.wg.Wait()
+		log.Flush()
+		assert.Contains(strings.Join(tp.Lines(), "\n"), "Flush callback panicked: oops")
+	})
+}